@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isMachO reports whether the file at name is a Mach-O or fat (universal)
+// binary, going by its magic number.
+func isMachO(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false, err
+	}
+
+	var hdr [8]byte
+	if _, err = io.ReadFull(f, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	switch binary.BigEndian.Uint32(hdr[:4]) {
+	case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe: // MH_MAGIC(_64), both byte orders
+		return true, nil
+	case 0xcafebabe, 0xbebafeca: // FAT_MAGIC, or a Java class file
+		// the number of architectures of a fat binary is small, the
+		// version of a class file isn't
+		n := binary.BigEndian.Uint32(hdr[4:])
+		if hdr[0] == 0xbe {
+			n = binary.LittleEndian.Uint32(hdr[4:])
+		}
+		return n > 0 && n < 20, nil
+	}
+	return false, nil
+}
+
+// PatchBinary adds load commands to a single Mach-O or fat binary: a
+// dylib, an executable, or a framework's binary outside of any bundle.
+// The dylibs themselves aren't copied anywhere, only the load commands are
+// added. Like Patch, the output is only replaced once it's complete.
+func PatchBinary(ctx context.Context, args Args) error {
+	lcs, err := binaryLoadCommands(args)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fi, err := os.Stat(args.Input)
+	if err != nil {
+		return err
+	}
+	o, err := os.CreateTemp(filepath.Dir(args.Output), ".ipapatch-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(o.Name()) // no-op after a successful rename
+	if err = o.Close(); err != nil {
+		return err
+	}
+	if err = copyfile(args.Input, o.Name()); err != nil {
+		return err
+	}
+	if err = os.Chmod(o.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// used to re-sign binaries whose signature has no identifier
+	id := args.SignID
+	if id == "" {
+		id = filepath.Base(args.Input)
+	}
+
+	if err = checkEncryptedFile(o.Name(), filepath.Base(args.Input), args.AllowEncrypted); err != nil {
+		return err
+	}
+
+	progress.SetPhase("injecting")
+	w := newWorkers(args.Jobs)
+	for _, lc := range lcs {
+		logger.Infof("adding %s...", lc.Name)
+		if err = injectLC(ctx, w, o.Name(), id, lc, tmpdir); err != nil {
+			if strings.Contains(err.Error(), "already exists (already patched)") {
+				logger.Infof("%s already patched (skipping '%s')", filepath.Base(args.Input), lc.Name)
+				continue
+			}
+			return fmt.Errorf("couldn't inject '%s': %w", lc.Name, err)
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(o.Name(), args.Output)
+}
+
+// binaryLoadCommands returns the load commands to add to a standalone
+// binary: the ones for the dylibs (or payload, or recipe) that would be
+// injected into a bundle, plus the ones given with --load-name. If there's
+// nothing but --load-name, the payload isn't added.
+func binaryLoadCommands(args Args) ([]loadCommand, error) {
+	cmd, err := parseLoadCmd(args.LoadCmd)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := parsePosition(args.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	var lcs []loadCommand
+	if len(args.LoadName) == 0 || len(args.Dylib) > 0 || args.Payload != "" || args.Recipe != "" {
+		p, err := buildPlan(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.PlistEdits) > 0 || len(p.Remove) > 0 {
+			logger.Info("Info.plist edits and removals don't apply to a single binary, ignoring them")
+		}
+		for _, inj := range p.Injections {
+			lcs = append(lcs, inj.LoadCommand)
+		}
+		logger.Info("only the load commands are added, make sure the dylibs can be found at runtime")
+	}
+	for _, name := range args.LoadName {
+		lcs = append(lcs, loadCommand{Name: name, Cmd: cmd, Position: pos})
+	}
+	return addOrder(lcs), nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/STARRY-S/zip"
+)
+
+// isIPAPath reports whether name is the name of an ipa to create.
+func isIPAPath(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".ipa" || ext == ".tipa"
+}
+
+// isDirOutput reports whether --output is a directory to put an app in:
+// named *.app, ending with a slash, or an existing directory.
+func isDirOutput(name string) bool {
+	if strings.EqualFold(filepath.Ext(filepath.Clean(name)), ".app") || os.IsPathSeparator(name[len(name)-1]) {
+		return true
+	}
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// appOutputPath returns where an app named appName goes for a directory
+// output: out itself if it's named *.app, otherwise inside of it, like in a
+// Payload directory.
+func appOutputPath(out, appName string) string {
+	out = filepath.Clean(out)
+	if strings.EqualFold(filepath.Ext(out), ".app") {
+		return out
+	}
+	return filepath.Join(out, appName)
+}
+
+// checkNotNested makes sure that writing to out can't touch in, since out
+// is replaced as a whole.
+func checkNotNested(in, out string) error {
+	absIn, err := filepath.Abs(in)
+	if err != nil {
+		return err
+	}
+	absOut, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	sep := string(filepath.Separator)
+	if absIn == absOut || strings.HasPrefix(absOut, absIn+sep) || strings.HasPrefix(absIn, absOut+sep) {
+		return fmt.Errorf("--output %s can't be the input, or be inside of it or contain it (use --inplace to patch the input)", out)
+	}
+	return nil
+}
+
+// PatchAppToDir patches a copy of the .app at args.Input, leaving the
+// original untouched. Unchanged files are hard linked where possible.
+func PatchAppToDir(ctx context.Context, args Args) error {
+	dst := appOutputPath(args.Output, filepath.Base(args.Input))
+	if err := checkNotNested(args.Input, dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".ipapatch-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	clone := filepath.Join(tmp, filepath.Base(dst))
+	logger.Infof("copying %s...", filepath.Base(args.Input))
+	if err = cloneTree(ctx, args.Input, clone); err != nil {
+		return err
+	}
+
+	a := args
+	a.Input = clone
+	if err = patchAppBundle(ctx, a, true); err != nil {
+		return err
+	}
+	return replaceDir(clone, dst)
+}
+
+// PatchAppToIPA patches a copy of the .app at args.Input and packages it
+// as an ipa.
+func PatchAppToIPA(ctx context.Context, args Args) error {
+	if err := checkNotNested(args.Input, args.Output); err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-app-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	clone := filepath.Join(tmpdir, filepath.Base(args.Input))
+	logger.Infof("copying %s...", filepath.Base(args.Input))
+	if err = cloneTree(ctx, args.Input, clone); err != nil {
+		return err
+	}
+
+	a := args
+	a.Input = clone
+	if err = patchAppBundle(ctx, a, true); err != nil {
+		return err
+	}
+
+	wo, err := packOptions(args, filepath.Join(clone, "Info.plist"))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("packaging ipa...")
+	return writeIPA(ctx, clone, args.Output, wo)
+}
+
+// writeIPA packages the app at app as the ipa out, at Payload/<name>.app.
+func writeIPA(ctx context.Context, app, out string, wo writeOptions) error {
+	o, err := os.CreateTemp(filepath.Dir(out), ".ipapatch-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(o.Name()) // no-op after a successful rename
+	defer o.Close()
+	if err = o.Chmod(0644); err != nil {
+		return err
+	}
+
+	progress.SetPhase("writing")
+	progress.SetWriteTotal(int64(treeSize(app))) // compressed, it'll be less
+	zw := newZipWriter(progress.Writing(o), wo.Level)
+	if err = packDir(ctx, zw, app, "Payload/"+filepath.Base(app), wo); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = o.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(o.Name(), out)
+}
+
+// PatchIPAToDir patches the ipa at args.Input and extracts the patched app
+// to args.Output.
+func PatchIPAToDir(ctx context.Context, args Args) error {
+	appName, err := ipaAppName(args.Input)
+	if err != nil {
+		return err
+	}
+
+	dst := appOutputPath(args.Output, appName)
+	if err = checkNotNested(args.Input, dst); err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	a := args
+	a.Output = filepath.Join(tmpdir, "patched.ipa")
+	a.InPlace = false
+	if err = Patch(ctx, a); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".ipapatch-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	logger.Infof("extracting %s...", appName)
+	app := filepath.Join(tmp, filepath.Base(dst))
+	if err = unpackIPA(ctx, a.Output, app, true); err != nil {
+		return err
+	}
+	return replaceDir(app, dst)
+}
+
+// ipaAppName returns the name of the app in the ipa at name, e.g.
+// "YouTube.app".
+func ipaAppName(name string) (string, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+
+	layout, err := parseLayout(z.File)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(layout.AppDir), nil
+}
+
+// symlinkOnPath returns the first symlink on the way from root to name,
+// which is inside of it (name included), or "" if there's none. Parts of
+// name that don't exist yet aren't symlinks. It's an error for name to be
+// outside of root.
+func symlinkOnPath(root, name string) (string, error) {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "", nil
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't inside %s", name, root)
+	}
+
+	p := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+// checkNoSymlink returns an error if what, at name in the bundle at root,
+// is reached through a symlink, so that it isn't written to.
+func checkNoSymlink(root, name, what string) error {
+	link, err := symlinkOnPath(root, name)
+	if err != nil {
+		return err
+	}
+	if link == "" {
+		return nil
+	}
+	if rel, err := filepath.Rel(root, link); err == nil {
+		link = filepath.ToSlash(rel)
+	}
+	return fmt.Errorf("%w: %s is reached through %s", ErrSymlink, what, link)
+}
+
+// replaceDir moves the directory src to dst, replacing whatever is there.
+func replaceDir(src, dst string) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// packOptions returns the metadata to use for the files of an app packaged
+// by ipapatch: their own, unless the output should be reproducible (see
+// --reproducible), in which case it's the same as for files added to an
+// ipa, with infoPlist standing in for the app's Info.plist in the ipa.
+func packOptions(args Args, infoPlist string) (writeOptions, error) {
+	wo := writeOptions{Level: args.Compression}
+	epoch, ok, err := sourceDateEpoch()
+	if err != nil {
+		return wo, err
+	}
+	if ok {
+		wo.ModTime, wo.ForceModTime, wo.NormalizeMode = epoch, true, true
+		return wo, nil
+	}
+	if !args.Reproducible {
+		return wo, nil
+	}
+
+	fi, err := os.Stat(infoPlist)
+	if err != nil {
+		return wo, err
+	}
+	wo.ModTime, wo.ForceModTime, wo.NormalizeMode = fi.ModTime(), true, true
+	return wo, nil
+}
+
+// packDir adds the directory root to zw as prefix, e.g. "Payload/Foo.app",
+// after the directories above it. Files keep their modification time and
+// mode, unless wo says otherwise, and symlinks are stored as such.
+func packDir(ctx context.Context, zw *zip.Writer, root, prefix string, wo writeOptions) error {
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	var parents []string
+	for dir := path.Dir(prefix); dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for _, dir := range slices.Backward(parents) {
+		hdr := &zip.FileHeader{Name: dir + "/", Modified: rootInfo.ModTime()}
+		if wo.ForceModTime {
+			hdr.Modified = wo.ModTime
+		}
+		hdr.SetMode(fs.ModeDir | 0755)
+		if _, err = zw.CreateHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if wo.ForceModTime {
+			hdr.Modified = wo.ModTime
+		}
+
+		switch {
+		case d.IsDir():
+			hdr.Name += "/"
+			_, err = zw.CreateHeader(hdr)
+			return err
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return appendToZip(zw, hdr, strings.NewReader(link))
+		case !d.Type().IsRegular():
+			logger.Infof("skipping %s (not a regular file)", hdr.Name)
+			return nil
+		}
+
+		hdr.Method = wo.method()
+		if wo.NormalizeMode {
+			hdr.SetMode(normalizedMode(fi.Mode(), false))
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return appendToZip(zw, hdr, ctxReader{ctx, f})
+	})
+}
+
+// unpackIPA extracts the ipa at name to dst: only its app if appOnly is
+// set, otherwise everything in it (Payload/Foo.app, and whatever else is
+// next to it). Symlinks are recreated, as long as they stay inside of dst.
+func unpackIPA(ctx context.Context, name, dst string, appOnly bool) error {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+
+	layout, err := parseLayout(z.File)
+	if err != nil {
+		return err
+	}
+
+	progress.SetPhase("extracting")
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, f := range z.File {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		rel := normalizeEntryName(f.Name)
+		if appOnly {
+			var ok bool
+			if rel, ok = strings.CutPrefix(rel, layout.AppDir+"/"); !ok {
+				continue
+			}
+		}
+		rel = strings.TrimSuffix(rel, "/")
+		if rel == "" {
+			continue
+		}
+		if !validBundlePath(rel) {
+			return fmt.Errorf("refusing to extract %q: it points outside of the output", f.Name)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			if err = checkNoSymlink(dst, target, f.Name); err == nil {
+				err = os.MkdirAll(target, 0755)
+			}
+		case mode&fs.ModeSymlink != 0:
+			err = extractSymlink(f, rel, dst, target)
+		default:
+			err = extractFile(f, dst, target)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, dst, target string) error {
+	if err := checkNoSymlink(dst, filepath.Dir(target), f.Name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	mode := f.Mode().Perm()
+	if mode == 0 {
+		mode = 0644 // made on a system without permissions
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(progress.Copying(out), r); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Time{}, f.Modified)
+}
+
+// extractSymlink recreates the symlink f, at rel in the output, refusing
+// ones that point outside of it.
+func extractSymlink(f *zip.File, rel, dst, target string) error {
+	if err := checkNoSymlink(dst, filepath.Dir(target), f.Name); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	link, err := io.ReadAll(io.LimitReader(r, 4096))
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(string(link)) || strings.Contains(string(link), "\\") ||
+		!validBundlePath(path.Join(path.Dir(rel), string(link))) {
+		return fmt.Errorf("symlink to %q points outside of the output", link)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(string(link), target)
+}
+
+// cloneTree copies the directory from to to, hard linking files where
+// possible, and copying them (keeping their mode and modification time)
+// where not, e.g. across filesystems.
+func cloneTree(ctx context.Context, from, to string) error {
+	return filepath.WalkDir(from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(to, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dst, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dst)
+		}
+
+		if os.Link(p, dst) == nil {
+			return nil
+		}
+		return copyFileMeta(p, dst)
+	})
+}
+
+// breakLink replaces the file at name with a copy of itself, so that
+// writing to it doesn't change other hard links to the same file.
+func breakLink(name string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".ipapatch-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err = copyFileMeta(name, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// copyFileMeta copies a file, keeping its mode and modification time.
+func copyFileMeta(from, to string) error {
+	fi, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if err = copyfile(from, to); err != nil {
+		return err
+	}
+	if err = os.Chmod(to, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(to, time.Time{}, fi.ModTime())
+}
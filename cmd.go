@@ -7,36 +7,187 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-const helpText = `usage: ipapatch [-h/--help] [-i/--input <path>] [-o/--output <path>] [-d/--dylib <path> ...] [-f/--inplace] [-y/--noconfirm] [-p/--plugins-only] [-z/--zip] [--version]
+const helpText = `usage: ipapatch [pack <app> | unpack <ipa> | inspect <path>] [-h/--help] [-i/--input <path>] [-o/--output <path>] [--input-type <type>] [-d/--dylib <path> ...] [--payload <name>] [--recipe <path>] [--load-cmd <type>] [--load-name <name> ...] [--position <where>] [--sign-id <id>] [-f/--inplace] [-y/--noconfirm] [-p/--plugins-only] [--include-plugin <pattern> ...] [--exclude-plugin <pattern> ...] [--allow-encrypted] [--reproducible] [--tmpdir <path>] [--compression <level>] [--mem-limit <MiB>] [-j/--jobs <n>] [-q/--quiet] [--log-format <format>] [-z/--zip] [--list-payloads] [--version]
+
+commands:
+  pack app              package a .app (or a Payload directory) as an ipa, at
+                        --output or ./<name>.ipa
+  unpack ipa            extract an ipa to the --output directory (default:
+                        ./<name>), or only its app if --output is a *.app
+  inspect path          show the bundles in an ipa or .app (or a binary) and
+                        whether their executables can be patched
+  (none)                patch --input
 
 flags:
-  -i, --input path      the path to the ipa or .app bundle to patch (required)
-  -o, --output path     the path to the patched ipa file to create (ipa/tipa only);
-                        if omitted, the input file is overwritten
-  -d, --dylib path      path to a dylib to use instead of the embedded zxPluginsInject
+  -i, --input path      the path to the ipa (whatever its extension), .app bundle,
+                        Payload directory or Mach-O binary (a dylib, executable,
+                        ...) to patch (required)
+  -o, --output path     the path to the patched ipa or binary to create; an ipa
+                        can also be extracted to a *.app or an existing (or
+                        slash-terminated) directory, and a .app bundle can be
+                        copied to a directory or packaged as an .ipa; if omitted,
+                        the input is overwritten
+  --input-type type     ipa, app or macho: what the input is, if detecting it from
+                        its contents gets it wrong
+  -d, --dylib path      path to a dylib to use instead of the embedded payload
                         can be repeated to inject multiple dylibs:
                           -d tweak1.dylib -d tweak2.dylib ...
+                        each one can be followed by where to inject it: main,
+                        plugins, all or globs matching executable names, bundle
+                        IDs or extension points, separated by commas:
+                          -d log.dylib:main -d zx.dylib:plugins
+                          -d tweak.dylib:main,com.apple.share-services
+                        (default: all, or plugins with -p)
+  --payload name        the embedded payload to inject if no -d is given
+                        (default: zxPluginsInject, see --list-payloads), can be
+                        followed by where to inject it like -d
+  --recipe path         a YAML/JSON/TOML file listing the dylibs and frameworks to
+                        inject, Info.plist edits and bundles to remove
+                        (can't be combined with -d, --payload or -p)
+  --load-cmd type       weak (default) or strong, the load command added for -d
+                        and --load-name dylibs
+  --load-name name      Mach-O inputs only: a load command to add as-is, e.g.
+                        @executable_path/Frameworks/tweak.dylib, can be repeated
+  --position where      where the added load commands go among the dylibs each
+                        binary loads, which is the order their initializers run
+                        in: last (default), first, before:<dylib> or
+                        after:<dylib>, where <dylib> is a path or a part of one
+                        (UIKit, Foo.framework, libswiftCore.dylib, libSystem);
+                        binaries that don't load it get them last
+  --sign-id id          Mach-O inputs only: the identifier to re-sign with if the
+                        binary's signature has none (default: its file name)
   -f, --inplace         overwrite the input file (implicit if --output is not provided)
   -y, --noconfirm       skip interactive confirmation when overwriting an existing output file
   -p, --plugins-only    only inject into plugin binaries (not the main executable)
-  -z, --zip             use the zip cli tool to remove files (ipa/tipa only; shouldn't be needed anymore)
+  --include-plugin pattern
+                        only patch plugins whose executable name, bundle ID or
+                        extension point matches the glob, can be repeated:
+                          --include-plugin com.apple.share-services \
+                          --include-plugin 'com.apple.widgetkit-*'
+  --exclude-plugin pattern
+                        don't patch plugins matching the glob, can be repeated
+  --allow-encrypted     patch executables still encrypted by the App Store anyway
+                        (they won't launch until decrypted), instead of failing
+  --reproducible        make the output depend only on the inputs: added files get
+                        fixed permissions and the app's Info.plist timestamp, or
+                        $SOURCE_DATE_EPOCH if set (which implies --reproducible)
+  --tmpdir path         where to put temporary files (default: $TMPDIR or the system
+                        temp dir); free space is checked before patching
+  --compression level   how to compress written files: 0 stores them (fastest, for
+                        local tests), 1 to 9 is the deflate level (default: 6);
+                        files copied from the input ipa keep their compression
+  --mem-limit MiB       patch executables up to this size in memory instead of
+                        extracting them to --tmpdir; 0 always uses temp files
+                        (default: 64)
+  -j, --jobs n          how many executables (and slices of universal ones) to
+                        patch at once (default: the number of CPUs)
+  -q, --quiet           don't show progress (a status line on terminals, JSON
+                        objects every 2 seconds otherwise)
+  --log-format format   console (default) or json
+  -z, --zip             no-op, kept for compatibility (the ipa is always rewritten
+                        without the replaced entries, no zip cli tool needed)
 
 info:
   -h, --help            show usage and exit
-  --version             show version and exit`
+  --version             show version (and the embedded payload) and exit
+  --list-payloads       show details of the embedded payloads and exit
+
+config:
+  defaults can be set in ~/.config/ipapatch/config.toml (or the file in
+  $IPAPATCH_CONFIG), with the keys noconfirm, dylibs, payload, plugins_only,
+  reproducible, tmpdir, compression, mem_limit, jobs, quiet and log_format,
+  or with the environment variables IPAPATCH_NOCONFIRM, IPAPATCH_DYLIBS
+  (separated by semicolons), IPAPATCH_PAYLOAD, IPAPATCH_PLUGINS_ONLY,
+  IPAPATCH_REPRODUCIBLE, IPAPATCH_TMPDIR, IPAPATCH_COMPRESSION,
+  IPAPATCH_MEM_LIMIT, IPAPATCH_JOBS, IPAPATCH_QUIET and IPAPATCH_LOG_FORMAT.
+  flags override the environment, which overrides the config file.`
 
+// Args are the command line flags, most of which can also be set with an
+// IPAPATCH_* environment variable or in the config file (see Config).
 type Args struct {
-	Input       string   `arg:"-i,--input,required"`
-	Output      string   `arg:"-o,--output"`
-	Dylib       []string `arg:"-d,--dylib,separate"`
-	InPlace     bool     `arg:"-f,--inplace"`
-	NoConfirm   bool     `arg:"-y,--noconfirm"`
-	PluginsOnly bool     `arg:"-p,--plugins-only"`
-	UseZip      bool     `arg:"-z,--zip"`
+	Input          string   `arg:"-i,--input"`
+	Output         string   `arg:"-o,--output"`
+	InputType      string   `arg:"--input-type"`
+	Dylib          []string `arg:"-d,--dylib,separate"` // and $IPAPATCH_DYLIBS, see Config.Merge
+	Payload        string   `arg:"--payload,env:IPAPATCH_PAYLOAD"`
+	Recipe         string   `arg:"--recipe"`
+	LoadCmd        string   `arg:"--load-cmd"`
+	LoadName       []string `arg:"--load-name,separate"`
+	Position       string   `arg:"--position"`
+	SignID         string   `arg:"--sign-id"`
+	InPlace        bool     `arg:"-f,--inplace"`
+	NoConfirm      bool     `arg:"-y,--noconfirm,env:IPAPATCH_NOCONFIRM"`
+	PluginsOnly    bool     `arg:"-p,--plugins-only,env:IPAPATCH_PLUGINS_ONLY"`
+	IncludePlugin  []string `arg:"--include-plugin,separate"`
+	ExcludePlugin  []string `arg:"--exclude-plugin,separate"`
+	AllowEncrypted bool     `arg:"--allow-encrypted"`
+	Reproducible   bool     `arg:"--reproducible,env:IPAPATCH_REPRODUCIBLE"`
+	TmpDir         string   `arg:"--tmpdir,env:IPAPATCH_TMPDIR"`
+	Compression    int      `arg:"--compression,env:IPAPATCH_COMPRESSION"`
+	MemLimit       int64    `arg:"--mem-limit,env:IPAPATCH_MEM_LIMIT"` // MiB
+	Jobs           int      `arg:"-j,--jobs,env:IPAPATCH_JOBS"`        // 0 for one per CPU
+	Quiet          bool     `arg:"-q,--quiet,env:IPAPATCH_QUIET"`
+	LogFormat      string   `arg:"--log-format,env:IPAPATCH_LOG_FORMAT"`
+	UseZip         bool     `arg:"-z,--zip"`
+	ListPayloads   bool     `arg:"--list-payloads"`
+
+	Pack    *PackCmd    `arg:"subcommand:pack"`
+	Unpack  *UnpackCmd  `arg:"subcommand:unpack"`
+	Inspect *InspectCmd `arg:"subcommand:inspect"`
+}
+
+// PackCmd is `ipapatch pack`, which packages a .app as an ipa.
+type PackCmd struct {
+	App string `arg:"positional"`
+}
+
+// UnpackCmd is `ipapatch unpack`, which extracts an ipa.
+type UnpackCmd struct {
+	IPA string `arg:"positional"`
+}
+
+// InspectCmd is `ipapatch inspect`, which describes an input without
+// patching it.
+type InspectCmd struct {
+	Input string `arg:"positional"`
 }
 
 func (Args) Version() string {
-	return "ipapatch v2.1.3"
+	v := "ipapatch v2.1.3"
+	for _, p := range payloads {
+		m, err := p.Manifest()
+		if err != nil {
+			v += fmt.Sprintf("\nembedded payload %s: %v", p.Name, err)
+			continue
+		}
+		v += fmt.Sprintf("\nembedded payload %s: %s", p.Name, m)
+	}
+	return v
+}
+
+// ListPayloads prints the details of every embedded payload.
+func ListPayloads() error {
+	for i, p := range payloads {
+		m, err := p.Manifest()
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			fmt.Println(p.Name, "(default)")
+		} else {
+			fmt.Println(p.Name)
+		}
+		fmt.Println("  file:        ", m.Name)
+		fmt.Println("  version:     ", m.Version)
+		fmt.Println("  arches:      ", strings.Join(m.Arches, ", "))
+		fmt.Println("  size:        ", m.Size)
+		fmt.Println("  sha256:      ", m.SHA256)
+		fmt.Println("  load command:", p.LoadName)
+		fmt.Println("  placed at:   ", p.Dest)
+		fmt.Println("  injected in: ", p.Targets)
+	}
+	return nil
 }
 
 func AskInteractively(question string) bool {
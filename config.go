@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds per-user defaults for Args, read from
+// ~/.config/ipapatch/config.toml (or $IPAPATCH_CONFIG). Command line flags
+// override environment variables (IPAPATCH_*), which override the config
+// file, which overrides the built-in defaults.
+type Config struct {
+	NoConfirm    bool     `toml:"noconfirm"`
+	Dylibs       []string `toml:"dylibs"` // relative to the config file
+	Payload      string   `toml:"payload"`
+	PluginsOnly  bool     `toml:"plugins_only"`
+	Reproducible bool     `toml:"reproducible"`
+	TmpDir       string   `toml:"tmpdir"`
+	MemLimit     *int64   `toml:"mem_limit"`   // MiB, nil for the default
+	Compression  *int     `toml:"compression"` // nil for the default
+	Jobs         int      `toml:"jobs"`
+	Quiet        bool     `toml:"quiet"`
+	LogFormat    string   `toml:"log_format"`
+}
+
+// defaultCompression is the default for --compression, the deflate level
+// compress/flate uses by default.
+const defaultCompression = 6
+
+// defaultMemLimit is the default for --mem-limit, in MiB. Most executables
+// are well under it, the rare huge ones go through temp files.
+const defaultMemLimit = 64
+
+func configPath() (string, error) {
+	if p := os.Getenv("IPAPATCH_CONFIG"); p != "" {
+		return p, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "ipapatch", "config.toml"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "ipapatch", "config.toml"), nil
+}
+
+// LoadConfig reads the config file. A missing file is an empty config,
+// unless it was explicitly set with $IPAPATCH_CONFIG.
+func LoadConfig() (*Config, error) {
+	p, err := configPath()
+	if err != nil {
+		return &Config{}, nil // no home dir, no config
+	}
+
+	var c Config
+	md, err := toml.DecodeFile(p, &c)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && os.Getenv("IPAPATCH_CONFIG") == "" {
+			return &Config{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config %s: %w", p, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key %q in config %s", undecoded[0].String(), p)
+	}
+
+	for i, d := range c.Dylibs {
+		if d != "" && !filepath.IsAbs(d) {
+			c.Dylibs[i] = filepath.Join(filepath.Dir(p), d)
+		}
+	}
+	return &c, nil
+}
+
+// Defaults returns the Args to parse the command line (and environment)
+// into, so whatever isn't set there keeps the value from the config.
+func (c *Config) Defaults() Args {
+	args := Args{
+		NoConfirm:    c.NoConfirm,
+		PluginsOnly:  c.PluginsOnly,
+		Reproducible: c.Reproducible,
+		TmpDir:       c.TmpDir,
+		MemLimit:     defaultMemLimit,
+		Compression:  defaultCompression,
+		Jobs:         c.Jobs,
+		Quiet:        c.Quiet,
+		LogFormat:    c.LogFormat,
+	}
+	if c.MemLimit != nil {
+		args.MemLimit = *c.MemLimit
+	}
+	if c.Compression != nil {
+		args.Compression = *c.Compression
+	}
+	return args
+}
+
+// Merge fills in what selects the dylibs to inject, unless something on the
+// command line (or in the environment) already did. Those can't just be
+// defaults: -d adds to a default list instead of replacing it, and a recipe
+// can't be combined with any of them, nor with plugins_only, which is
+// dropped for a recipe if it came from the config.
+//
+// $IPAPATCH_DYLIBS is read here rather than by go-arg, which would split it
+// on the commas between the selectors of a dylib (-d x.dylib:main,plugins).
+// Its dylibs are separated by semicolons instead.
+func (c *Config) Merge(args *Args) {
+	if env := os.Getenv("IPAPATCH_DYLIBS"); env != "" && len(args.Dylib) == 0 {
+		args.Dylib = strings.Split(env, ";")
+	}
+	if args.Recipe != "" {
+		if c.PluginsOnly {
+			args.PluginsOnly = false
+		}
+		return
+	}
+	if len(args.Dylib) == 0 && args.Payload == "" {
+		args.Dylib = c.Dylibs
+		args.Payload = c.Payload
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !(darwin || linux)
+
+package main
+
+func diskSpace(string) (free, dev uint64, err error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
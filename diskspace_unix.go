@@ -0,0 +1,20 @@
+//go:build darwin || linux
+
+package main
+
+import "syscall"
+
+// diskSpace returns the space available to unprivileged users on the
+// filesystem containing path, and the ID of the device it's on.
+func diskSpace(path string) (free, dev uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	var s syscall.Stat_t
+	if err = syscall.Stat(path, &s); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(s.Dev), nil
+}
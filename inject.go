@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/blacktop/go-macho"
 	"github.com/blacktop/go-macho/pkg/codesign"
@@ -13,40 +20,42 @@ import (
 	"github.com/blacktop/go-macho/types"
 )
 
-var ErrNoCodeDirectories = errors.New("no code directories")
+var (
+	ErrNoCodeDirectories = errors.New("no code directories")
+	ErrEncrypted         = errors.New("encrypted executable")
+	ErrNoHeaderSpace     = errors.New("not enough room for the load command")
+)
 
 var dylibCmdSize = binary.Size(types.DylibCmd{})
 
-func injectLC(fsPath, bundleID, lcName, tmpdir string) error {
+// injectLC adds lc to the executable at fsPath. The slices of fat files
+// are patched in parallel if w has workers to spare.
+func injectLC(ctx context.Context, w workers, fsPath, bundleID string, lc loadCommand, tmpdir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	fat, err := macho.OpenFat(fsPath)
 	if err == nil {
 		defer fat.Close() // in case of returning early
 
-		var slices []string
-		for _, arch := range fat.Arches {
-			if arch.SubCPU > 2 {
-				continue // skip armv7 and other unsupported architectures
-			}
-
-			if err = addDylibCommand(arch.File, lcName, bundleID); err != nil {
-				return err
-			}
-
-			tmp, err := os.CreateTemp(tmpdir, "macho_"+arch.File.CPU.String())
-			if err != nil {
-				return fmt.Errorf("failed to create temp file: %w", err)
-			}
-			defer os.Remove(tmp.Name())
-
-			if err = arch.File.Save(tmp.Name()); err != nil {
-				return fmt.Errorf("failed to save temp file: %w", err)
-			}
-
-			if err = tmp.Close(); err != nil {
-				return fmt.Errorf("failed to close temp file: %w", err)
+		arches := supportedArches(fat)
+		slices := make([]string, len(arches))
+		errs := make([]error, len(arches))
+		var wg sync.WaitGroup
+		for i, arch := range arches {
+			w.TryGo(&wg, func() {
+				slices[i], errs[i] = saveSlice(ctx, arch, bundleID, lc, tmpdir)
+			})
+		}
+		wg.Wait()
+		for _, s := range slices {
+			if s != "" {
+				defer os.Remove(s)
 			}
-
-			slices = append(slices, tmp.Name())
+		}
+		if err = firstError(errs); err != nil {
+			return err
 		}
 		fat.Close()
 
@@ -63,12 +72,13 @@ func injectLC(fsPath, bundleID, lcName, tmpdir string) error {
 		}
 		defer m.Close()
 
-		if err = addDylibCommand(m, lcName, bundleID); err != nil {
+		patched, err := addDylibCommand(m, lc, bundleID)
+		if err != nil {
 			return err
 		}
 
 		// uses WriteFile internally, it also truncates
-		if err = m.Save(fsPath); err != nil {
+		if err = patched.Save(fsPath); err != nil {
 			return fmt.Errorf("failed to save patched MachO file: %w", err)
 		}
 		return nil
@@ -76,7 +86,159 @@ func injectLC(fsPath, bundleID, lcName, tmpdir string) error {
 	return err
 }
 
-func addDylibCommand(m *macho.File, name, bundleID string) error {
+// saveSlice adds lc to a slice of a fat file and saves it to a new file in
+// tmpdir, returning its path.
+func saveSlice(ctx context.Context, arch macho.FatArch, bundleID string, lc loadCommand, tmpdir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	patched, err := addDylibCommand(arch.File, lc, bundleID)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(tmpdir, "macho_"+arch.File.CPU.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	if err = patched.Save(tmp.Name()); err != nil {
+		tmp.Close()
+		return tmp.Name(), fmt.Errorf("failed to save temp file: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return tmp.Name(), fmt.Errorf("failed to close temp file: %w", err)
+	}
+	return tmp.Name(), nil
+}
+
+// supportedArches returns the slices of fat to patch. armv7 and other
+// unsupported architectures are skipped, and left out of the result.
+func supportedArches(fat *macho.FatFile) []macho.FatArch {
+	var arches []macho.FatArch
+	for _, arch := range fat.Arches {
+		if arch.SubCPU <= 2 {
+			arches = append(arches, arch)
+		}
+	}
+	return arches
+}
+
+// firstError returns the first non-nil error in errs, which keeps errors
+// from parallel work as deterministic as the work itself.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// injectLCBytes is injectLC for an executable that's been read into
+// memory; it returns the patched executable.
+func injectLCBytes(ctx context.Context, w workers, data []byte, bundleID string, lc loadCommand) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err == nil {
+		arches := supportedArches(fat)
+		slices := make([]fatSlice, len(arches))
+		errs := make([]error, len(arches))
+		var wg sync.WaitGroup
+		for i, arch := range arches {
+			w.TryGo(&wg, func() {
+				if errs[i] = ctx.Err(); errs[i] != nil {
+					return
+				}
+				patched, err := addDylibCommand(arch.File, lc, bundleID)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				var buf bytes.Buffer
+				if err := patched.SaveBuffer(&buf); err != nil {
+					errs[i] = fmt.Errorf("failed to save %s slice: %w", arch.File.CPU, err)
+					return
+				}
+				slices[i] = fatSlice{arch.CPU, arch.SubCPU, buf.Bytes()}
+			})
+		}
+		wg.Wait()
+		if err = firstError(errs); err != nil {
+			return nil, err
+		}
+		return createFat(slices)
+	} else if errors.Is(err, macho.ErrNotFat) {
+		m, err := macho.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open MachO file: %w", err)
+		}
+
+		patched, err := addDylibCommand(m, lc, bundleID)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err = patched.SaveBuffer(&buf); err != nil {
+			return nil, fmt.Errorf("failed to save patched MachO file: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, err
+}
+
+type fatSlice struct {
+	cpu    types.CPU
+	subCPU types.CPUSubtype
+	data   []byte
+}
+
+// fatAlignBits is the alignment of the slices in fat files, the same
+// macho.CreateFat uses.
+const fatAlignBits = 14
+
+// createFat is macho.CreateFat, but in memory.
+func createFat(slices []fatSlice) ([]byte, error) {
+	const align = 1 << fatAlignBits
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, types.MagicFat)
+	binary.Write(&buf, binary.BigEndian, uint32(len(slices)))
+
+	offset := uint32(align)
+	for _, s := range slices {
+		err := binary.Write(&buf, binary.BigEndian, macho.FatArchHeader{
+			CPU:    s.cpu,
+			SubCPU: s.subCPU,
+			Offset: offset,
+			Size:   uint32(len(s.data)),
+			Align:  fatAlignBits,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to write fat header: %w", err)
+		}
+		offset += uint32(len(s.data))
+		offset = (offset + align - 1) / align * align
+	}
+
+	for _, s := range slices {
+		// pad up to the alignment of the slice
+		buf.Write(make([]byte, (align-buf.Len()%align)%align))
+		buf.Write(s.data)
+	}
+	return buf.Bytes(), nil
+}
+
+// addDylibCommand adds dylib to m, at its position, and re-signs it. The
+// result is m itself unless dylib doesn't go last, in which case it's m
+// re-read with the dylib ordinals after it renumbered.
+func addDylibCommand(m *macho.File, dylib loadCommand, bundleID string) (*macho.File, error) {
 	var cs *macho.CodeSignature
 	for i := len(m.Loads) - 1; i >= 0; i-- {
 		lc := m.Loads[i]
@@ -88,28 +250,69 @@ func addDylibCommand(m *macho.File, name, bundleID string) error {
 		if cmd != types.LC_LOAD_WEAK_DYLIB && cmd != types.LC_LOAD_DYLIB {
 			continue
 		}
-		if strings.HasPrefix(lc.String(), name) {
-			return fmt.Errorf("load command '%s' already exists (already patched)", name)
+		if strings.HasPrefix(lc.String(), dylib.Name) {
+			return nil, fmt.Errorf("load command '%s' already exists (already patched)", dylib.Name)
 		}
 	}
 
+	ordinal := dylibOrdinal(m, dylib)
+	if ordinal != 0 {
+		// everything referring to the dylibs from ordinal on has to follow
+		// them, which is only possible on the saved bytes
+		var buf bytes.Buffer
+		if err := m.SaveBuffer(&buf); err != nil {
+			return nil, fmt.Errorf("failed to save MachO file: %w", err)
+		}
+		data := buf.Bytes()
+		if err := shiftOrdinals(m, data, ordinal); err != nil {
+			return nil, fmt.Errorf("%w (the %s slice can't take '%s' at %s)", err, strings.ToLower(m.SubCPU.String(m.CPU)), dylib.Name, dylib.Position)
+		}
+		var err error
+		if m, err = macho.NewFile(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to open renumbered MachO file: %w", err)
+		}
+	}
+
+	// the code signature is added back by CodeSign below
+	size := pointerAlign(uint32(dylibCmdSize + len(dylib.Name) + 1))
+	var reserved uint32
+	if cs != nil {
+		reserved = cs.LoadSize()
+	}
+	if err := makeRoom(m, size, reserved); err != nil {
+		return nil, err
+	}
+
 	var vers types.Version
 	vers.Set("0.0.0")
 
 	m.AddLoad(&macho.Dylib{
 		DylibCmd: types.DylibCmd{
-			LoadCmd:        types.LC_LOAD_WEAK_DYLIB,
-			Len:            pointerAlign(uint32(dylibCmdSize + len(name) + 1)),
+			LoadCmd:        dylib.Cmd,
+			Len:            size,
 			NameOffset:     0x18,
 			Timestamp:      2, // TODO: I've only seen this value be 2
 			CurrentVersion: vers,
 			CompatVersion:  vers,
 		},
-		Name: name,
+		Name: dylib.Name,
 	})
+	if ordinal != 0 {
+		// move it from the end to just before the dylib it takes the
+		// ordinal of
+		loads := m.Loads[:len(m.Loads)-1]
+		n := 0
+		i := slices.IndexFunc(loads, func(l macho.Load) bool {
+			if isDylibLoad(l.Command()) {
+				n++
+			}
+			return n == ordinal
+		})
+		m.Loads = slices.Insert(loads, i, m.Loads[len(m.Loads)-1])
+	}
 	if cs != nil {
 		if len(cs.CodeDirectories) == 0 {
-			return ErrNoCodeDirectories
+			return nil, ErrNoCodeDirectories
 		}
 		cd := cs.CodeDirectories[0]
 		if cd.ID == "" {
@@ -120,7 +323,8 @@ func addDylibCommand(m *macho.File, name, bundleID string) error {
 		}
 
 		// https://github.com/blacktop/go-macho/blob/0247374e8fc354e575b62401a6ec2195d1fae49f/export.go#L265
-		return m.CodeSign(&codesign.Config{
+		defer progress.SliceSigned()
+		return m, m.CodeSign(&codesign.Config{
 			Flags:           cd.Header.Flags | cstypes.ADHOC,
 			ID:              cd.ID,
 			TeamID:          cd.TeamID,
@@ -129,9 +333,186 @@ func addDylibCommand(m *macho.File, name, bundleID string) error {
 			SpecialSlots:    []cstypes.SpecialSlot{{Hash: cstypes.EmptySha256Slot}}, // YES this is actually needed
 		})
 	}
+	return m, nil
+}
+
+// dylibOrdinal returns the ordinal dylib gets in m at its position, or 0
+// if it goes after every dylib m loads, which leaves the others as they
+// are. If m doesn't load the dylib the position refers to, it goes last.
+func dylibOrdinal(m *macho.File, dylib loadCommand) int {
+	pos := dylib.Position
+	libs := m.ImportedLibraries()
+	ordinal := 0
+	switch {
+	case pos.First:
+		ordinal = 1
+	case pos.Before != "" || pos.After != "":
+		name := cmp.Or(pos.Before, pos.After)
+		i := slices.IndexFunc(libs, func(lib string) bool {
+			return refersTo(name, lib)
+		})
+		if i < 0 {
+			logger.Infof("the %s slice doesn't load %s, adding '%s' after its dylibs",
+				strings.ToLower(m.SubCPU.String(m.CPU)), name, dylib.Name)
+			return 0
+		}
+		ordinal = i + 1
+		if pos.After != "" {
+			ordinal++
+		}
+	}
+	if ordinal > len(libs) {
+		return 0
+	}
+	return ordinal
+}
+
+// harmlessLoads are the load commands that can be removed to make room for
+// a new one when there's too little padding after the load commands: none
+// of them are used at runtime.
+var harmlessLoads = []types.LoadCmd{
+	types.LC_SOURCE_VERSION,
+	types.LC_DYLIB_CODE_SIGN_DRS,
+	types.LC_DATA_IN_CODE,
+	types.LC_FUNCTION_STARTS,
+}
+
+// headerPadding returns the free space between the end of the load
+// commands of m and the first data after them, which is how much the load
+// commands can grow without overwriting anything.
+func headerPadding(m *macho.File) uint32 {
+	end := uint64(m.HdrSize() + m.SizeCommands)
+	first := uint64(math.MaxUint64)
+	for _, sec := range m.Sections {
+		if sec.Offset != 0 && sec.Size > 0 && !sec.Flags.IsZerofill() {
+			first = min(first, uint64(sec.Offset))
+		}
+	}
+	for _, seg := range m.Segments() {
+		if seg.Filesz > 0 && seg.Offset > 0 {
+			first = min(first, seg.Offset)
+		}
+	}
+	if first == math.MaxUint64 || first < end {
+		return 0
+	}
+	return uint32(first - end)
+}
+
+// makeRoom makes sure that a load command of size bytes fits after the load
+// commands of m, on top of reserved bytes for ones that were removed only
+// to be added back. If the padding is too small, harmless load commands are
+// removed until it's enough, and if that doesn't do it either, it returns
+// ErrNoHeaderSpace with the bytes needed and available.
+func makeRoom(m *macho.File, size, reserved uint32) error {
+	arch := strings.ToLower(m.SubCPU.String(m.CPU))
+	available := int64(headerPadding(m)) - int64(reserved)
+	if available >= int64(size) {
+		return nil
+	}
+
+	free := available
+	var removed []string
+	for _, cmd := range harmlessLoads {
+		for _, l := range slices.Clone(m.Loads) {
+			if free < int64(size) && l.Command() == cmd {
+				m.RemoveLoad(l)
+				free += int64(l.LoadSize())
+				removed = append(removed, cmd.String())
+			}
+		}
+	}
+	if free < int64(size) {
+		return fmt.Errorf("%w: the %s slice needs %d bytes after its load commands, %d are free (%d after removing harmless ones)",
+			ErrNoHeaderSpace, arch, size, max(available, 0), max(free, 0))
+	}
+	logger.Infof("the %s slice needs %d bytes after its load commands but only %d are free, removed %s to make room",
+		arch, size, max(available, 0), strings.Join(removed, ", "))
 	return nil
 }
 
+// sliceInfo describes a slice of a Mach-O file, or the file itself if it
+// isn't fat.
+type sliceInfo struct {
+	Arch       string // e.g. "arm64e"
+	Encrypted  bool   // cryptid != 0, still encrypted by the App Store
+	HeaderFree uint32 // room for more load commands, see headerPadding
+}
+
+// machoSlices describes the slices of the Mach-O file in r.
+func machoSlices(r io.ReaderAt) ([]sliceInfo, error) {
+	fat, err := macho.NewFatFile(r)
+	if err == nil {
+		infos := make([]sliceInfo, len(fat.Arches))
+		for i, arch := range fat.Arches {
+			infos[i] = describeSlice(arch.File)
+		}
+		return infos, nil
+	} else if !errors.Is(err, macho.ErrNotFat) {
+		return nil, err
+	}
+
+	m, err := macho.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MachO file: %w", err)
+	}
+	return []sliceInfo{describeSlice(m)}, nil
+}
+
+func describeSlice(m *macho.File) sliceInfo {
+	info := sliceInfo{
+		Arch:       strings.ToLower(m.SubCPU.String(m.CPU)),
+		HeaderFree: headerPadding(m),
+	}
+	for _, l := range m.Loads {
+		switch e := l.(type) {
+		case *macho.EncryptionInfo:
+			info.Encrypted = info.Encrypted || e.CryptID != 0
+		case *macho.EncryptionInfo64:
+			info.Encrypted = info.Encrypted || e.CryptID != 0
+		}
+	}
+	return info
+}
+
+// checkEncrypted returns ErrEncrypted if any slice of the executable in r,
+// which is what, is still encrypted: adding a load command and re-signing
+// it would work, but the result can't run anywhere. If allow is set (see
+// --allow-encrypted), it only warns.
+func checkEncrypted(r io.ReaderAt, what string, allow bool) error {
+	infos, err := machoSlices(r)
+	if err != nil {
+		return err
+	}
+
+	var encrypted []string
+	for _, info := range infos {
+		if info.Encrypted {
+			encrypted = append(encrypted, info.Arch)
+		}
+	}
+	if len(encrypted) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s is encrypted (%s), decrypt it first or it won't launch once patched", what, strings.Join(encrypted, ", "))
+	if allow {
+		logger.Warnf("%s; patching it anyway (--allow-encrypted)", msg)
+		return nil
+	}
+	return fmt.Errorf("%w: %s (or pass --allow-encrypted)", ErrEncrypted, msg)
+}
+
+// checkEncryptedFile is checkEncrypted for the executable at name.
+func checkEncryptedFile(name, what string, allow bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkEncrypted(f, what, allow)
+}
+
 func pointerAlign(sz uint32) uint32 {
 	if (sz % 8) != 0 {
 		sz += 8 - (sz % 8)
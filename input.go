@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/STARRY-S/zip"
+)
+
+// inputType is what kind of thing is being patched.
+type inputType string
+
+const (
+	inputIPA   inputType = "ipa"   // a zip with Payload/*.app inside, whatever its extension
+	inputApp   inputType = "app"   // an extracted .app bundle
+	inputMachO inputType = "macho" // a single Mach-O or fat binary
+)
+
+// parseInputType parses the value of --input-type.
+func parseInputType(s string) (inputType, error) {
+	switch t := inputType(strings.ToLower(s)); t {
+	case inputIPA, inputApp, inputMachO:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown input type %q (expected ipa, app or macho)", s)
+}
+
+// detectInput figures out what name is by looking at its contents rather
+// than its extension: a zip with an app inside, a directory with an
+// Info.plist (an .app) or a Payload directory, or a Mach-O binary. For a
+// Payload directory, it returns the path to the .app inside.
+func detectInput(name string) (string, inputType, error) {
+	name = filepath.Clean(name) // e.g. a trailing slash
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	if fi.IsDir() {
+		app, err := resolveApp(name)
+		if err != nil {
+			return "", "", err
+		}
+		return app, inputApp, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(f, magic); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", "", err
+	}
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		z, err := zip.OpenReader(name)
+		if err != nil {
+			return "", "", fmt.Errorf("%s looks like a zip, but: %w", name, err)
+		}
+		defer z.Close()
+		if _, err = parseLayout(z.File); errors.Is(err, ErrUnsafeEntry) {
+			return "", "", fmt.Errorf("%s: %w", name, err)
+		} else if err != nil {
+			return "", "", fmt.Errorf("%s is a zip, but not an ipa: %w", name, err)
+		}
+		return name, inputIPA, nil
+	}
+
+	if ok, err := isMachO(name); err != nil {
+		return "", "", err
+	} else if ok {
+		return name, inputMachO, nil
+	}
+	return "", "", fmt.Errorf("don't know what to do with %s (expected an ipa, an .app or Payload directory, or a Mach-O binary)", name)
+}
+
+// resolveApp returns dir if it's an .app (it has an Info.plist), or the
+// .app inside it if it's a Payload directory.
+func resolveApp(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "Info.plist")); err == nil {
+		return dir, nil
+	}
+	return appInPayload(dir)
+}
+
+// appInPayload returns the only .app in dir, which is a Payload directory
+// (or anything else with an app in it).
+func appInPayload(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var apps []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".app") {
+			continue
+		}
+		app := filepath.Join(dir, e.Name())
+		if _, err := os.Stat(filepath.Join(app, "Info.plist")); err == nil {
+			apps = append(apps, app)
+		}
+	}
+
+	switch len(apps) {
+	case 0:
+		return "", fmt.Errorf("%s is neither an .app (no Info.plist) nor a Payload directory (no .app inside)", dir)
+	case 1:
+		return apps[0], nil
+	}
+	return "", fmt.Errorf("%w: found %d apps in %s (%s), expected exactly one", ErrAmbiguousPayload, len(apps), dir, strings.Join(apps, ", "))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/STARRY-S/zip"
+	"howett.net/plist"
+)
+
+func runInspect(args Args) {
+	if args.Inspect.Input != "" {
+		args.Input = args.Inspect.Input
+	}
+	if args.Input == "" {
+		logger.Fatal("inspect needs an ipa, .app or binary (see --help for usage)")
+	}
+
+	input, typ, err := detectInput(args.Input)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	switch typ {
+	case inputIPA:
+		args.Input = input
+		err = inspectIPA(os.Stdout, args)
+	case inputApp:
+		err = inspectApp(os.Stdout, input)
+	case inputMachO:
+		err = inspectBinary(os.Stdout, input)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// inspectIPA describes the main app and plugins in the ipa at args.Input,
+// and their executables. Like when patching, executables up to --mem-limit
+// are read into memory, bigger ones are extracted to --tmpdir.
+func inspectIPA(w io.Writer, args Args) error {
+	z, err := zip.OpenReader(args.Input)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	memLimit := uint64(max(args.MemLimit, 0)) << 20
+
+	layout, err := parseLayout(z.File)
+	if err != nil {
+		return err
+	}
+	plists, err := findPlists(layout, &plan{})
+	if err != nil {
+		return err
+	}
+
+	for _, plistPath := range plists {
+		pl, err := getExecutableNames(layout, plistPath)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", plistPath, err)
+		}
+
+		execPath := path.Join(path.Dir(plistPath), pl.Executable)
+		if link, ok := layout.symlinkOn(execPath); ok {
+			writeBundle(w, path.Dir(plistPath), pl, nil, fmt.Errorf("reached through the symlink %s", link))
+			continue
+		}
+		exec, closeExec, err := openExecutable(layout, execPath, memLimit, tmpdir)
+		writeBundle(w, path.Dir(plistPath), pl, exec, err)
+		closeExec()
+	}
+	return nil
+}
+
+// openExecutable returns the executable at name in the ipa, read into
+// memory if it's up to memLimit bytes, otherwise extracted to tmpdir. The
+// returned func releases it either way.
+func openExecutable(l *ipaLayout, name string, memLimit uint64, tmpdir string) (io.ReaderAt, func(), error) {
+	nop := func() {}
+	if f, ok := l.entries[name]; !ok || f.UncompressedSize64 <= memLimit {
+		data, err := readEntry(l, name)
+		return bytes.NewReader(data), nop, err
+	}
+
+	extracted, err := extractToPath(l, tmpdir, name)
+	if err != nil {
+		os.Remove(extracted)
+		return nil, nop, err
+	}
+	f, err := os.Open(extracted)
+	if err != nil {
+		os.Remove(extracted)
+		return nil, nop, err
+	}
+	return f, func() {
+		f.Close()
+		os.Remove(extracted)
+	}, nil
+}
+
+// inspectApp is inspectIPA for a .app on disk.
+func inspectApp(w io.Writer, app string) error {
+	var plists []string
+	if _, err := os.Stat(filepath.Join(app, "Info.plist")); err == nil {
+		plists = append(plists, filepath.Join(app, "Info.plist"))
+	}
+	err := filepath.WalkDir(app, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(p, ".appex/Info.plist") {
+			plists = append(plists, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, plistPath := range plists {
+		contents, err := os.ReadFile(plistPath)
+		if err != nil {
+			return err
+		}
+		var pl PlistInfo
+		if _, err = plist.Unmarshal(contents, &pl); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", plistPath, err)
+		}
+
+		dir := filepath.Dir(plistPath)
+		execPath := filepath.Join(dir, pl.Executable)
+		if link, err := symlinkOnPath(app, execPath); err != nil || link != "" {
+			if err == nil {
+				err = fmt.Errorf("reached through the symlink %s", link)
+			}
+			writeBundle(w, dir, &pl, nil, err)
+			continue
+		}
+		f, err := os.Open(execPath)
+		if err != nil {
+			writeBundle(w, dir, &pl, nil, err)
+			continue
+		}
+		writeBundle(w, dir, &pl, f, nil)
+		f.Close()
+	}
+	return nil
+}
+
+// inspectBinary describes the slices of a standalone Mach-O file.
+func inspectBinary(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	infos, err := machoSlices(f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, name)
+	writeSlices(w, infos)
+	return nil
+}
+
+// writeBundle writes what's known about the bundle in dir, whose Info.plist
+// is pl, and its executable: exec, or the error opening it.
+func writeBundle(w io.Writer, dir string, pl *PlistInfo, exec io.ReaderAt, err error) {
+	fmt.Fprintf(w, "%s: %s", dir, pl.BundleID)
+	if pl.Extension.PointIdentifier != "" {
+		fmt.Fprintf(w, " (%s)", pl.Extension.PointIdentifier)
+	}
+	fmt.Fprintf(w, "\n  executable: %s\n", pl.Executable)
+
+	var infos []sliceInfo
+	if err == nil {
+		infos, err = machoSlices(exec)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  error: %v\n", err)
+		return
+	}
+	writeSlices(w, infos)
+}
+
+func writeSlices(w io.Writer, infos []sliceInfo) {
+	for _, info := range infos {
+		encrypted := "not encrypted"
+		if info.Encrypted {
+			encrypted = "encrypted, can't be patched until decrypted"
+		}
+		fmt.Fprintf(w, "  %s: %s, %d bytes free for load commands\n", info.Arch, encrypted, info.HeaderFree)
+	}
+}
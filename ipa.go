@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -8,104 +11,406 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/STARRY-S/zip"
 	"howett.net/plist"
 )
 
 type PlistInfo struct {
-	Executable string `plist:"CFBundleExecutable"`
-	BundleID   string `plist:"CFBundleIdentifier"`
+	Executable string         `plist:"CFBundleExecutable"`
+	BundleID   string         `plist:"CFBundleIdentifier"`
+	Extension  PlistExtension `plist:"NSExtension"` // plugins only
+}
+
+type PlistExtension struct {
+	PointIdentifier string `plist:"NSExtensionPointIdentifier"` // e.g. com.apple.share-services
+}
+
+func (pl *PlistInfo) bundle(isPlugin bool) bundleInfo {
+	return bundleInfo{
+		IsPlugin:       isPlugin,
+		Executable:     pl.Executable,
+		BundleID:       pl.BundleID,
+		ExtensionPoint: pl.Extension.PointIdentifier,
+	}
 }
 
 var (
-	ErrNoPlist   = errors.New("no Info.plist found in ipa")
-	ErrNoPlugins = errors.New("no plugins found")
+	ErrNoPlist          = errors.New("no Info.plist found in ipa")
+	ErrNoPlugins        = errors.New("no plugins found")
+	ErrNoPayload        = errors.New("no Payload/*.app directory found in ipa")
+	ErrAmbiguousPayload = errors.New("ambiguous ipa layout")
+	ErrSymlink          = errors.New("refusing to write through a symlink")
+	ErrUnsafeEntry      = errors.New("unsafe entry name in ipa")
 )
 
-// injectAll patches the main executable and all plugins in an IPA/TIPA.
-// key - path to file in provided tmpdir, now patched
-// val - path inside ipa
-func injectAll(args Args, tmpdir string) (map[string]string, error) {
+// ipaLayout describes the app inside an ipa independently of how the entry
+// names were spelled by whatever tool zipped it. All names passed to its
+// methods are in the canonical form returned by normalizeEntryName.
+type ipaLayout struct {
+	AppDir  string // e.g. "Payload/YouTube.app"
+	rawDir  string // AppDir as spelled in the archive, e.g. "./payload/YouTube.app"
+	names   []string
+	entries map[string]*zip.File
+}
+
+// normalizeEntryName converts a zip entry name to the canonical form used
+// throughout ipapatch: forward slashes, no leading "./" or "/", and the
+// top-level Payload directory spelled exactly "Payload".
+func normalizeEntryName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	for strings.HasPrefix(name, "./") || strings.HasPrefix(name, "/") {
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+	}
+
+	first, rest, found := strings.Cut(name, "/")
+	if !strings.EqualFold(first, "Payload") {
+		return name
+	}
+	if !found {
+		return "Payload"
+	}
+	return "Payload/" + rest
+}
+
+// checkEntryNames makes sure that no entry can end up outside of wherever
+// the ipa is extracted, or be mixed up with another one: names can't be
+// absolute, have ".." in them or NUL bytes, and two entries can't be the
+// same path, spelled differently or only differing by case, since they'd be
+// the same file on case-insensitive filesystems like iOS's.
+func checkEntryNames(files []*zip.File) error {
+	type seenEntry struct {
+		name  string
+		isDir bool
+	}
+	seen := make(map[string]seenEntry, len(files))
+
+	for _, f := range files {
+		name := strings.ReplaceAll(f.Name, "\\", "/")
+		switch {
+		case strings.ContainsRune(name, 0):
+			return fmt.Errorf("%w: %q has a NUL byte", ErrUnsafeEntry, f.Name)
+		case strings.HasPrefix(name, "/") || len(name) >= 2 && name[1] == ':':
+			return fmt.Errorf("%w: %q is absolute", ErrUnsafeEntry, f.Name)
+		case slices.Contains(strings.Split(name, "/"), ".."):
+			return fmt.Errorf("%w: %q has a '..' in it", ErrUnsafeEntry, f.Name)
+		}
+
+		isDir := strings.HasSuffix(name, "/")
+		key := strings.ToLower(strings.TrimSuffix(normalizeEntryName(name), "/"))
+		if prev, ok := seen[key]; ok && !(prev.isDir && isDir) {
+			switch {
+			case prev.name == f.Name:
+				return fmt.Errorf("%w: %q appears twice", ErrUnsafeEntry, f.Name)
+			case strings.EqualFold(prev.name, f.Name):
+				return fmt.Errorf("%w: %q and %q only differ by case", ErrUnsafeEntry, prev.name, f.Name)
+			}
+			return fmt.Errorf("%w: %q and %q are the same path", ErrUnsafeEntry, prev.name, f.Name)
+		}
+		seen[key] = seenEntry{f.Name, isDir}
+	}
+	return nil
+}
+
+func parseLayout(files []*zip.File) (*ipaLayout, error) {
+	if err := checkEntryNames(files); err != nil {
+		return nil, err
+	}
+
+	l := &ipaLayout{
+		names:   make([]string, 0, len(files)),
+		entries: make(map[string]*zip.File, len(files)),
+	}
+
+	var apps, bare []string
+	for _, f := range files {
+		name := normalizeEntryName(f.Name)
+		if _, ok := l.entries[name]; !ok {
+			l.names = append(l.names, name)
+		}
+		l.entries[name] = f
+
+		parts := strings.Split(strings.TrimSuffix(name, "/"), "/")
+		if len(parts) < 2 || parts[0] != "Payload" || !strings.HasSuffix(strings.ToLower(parts[1]), ".app") {
+			continue
+		}
+		switch {
+		case len(parts) == 3 && parts[2] == "Info.plist":
+			apps = append(apps, parts[1])
+		case !slices.Contains(bare, parts[1]):
+			bare = append(bare, parts[1])
+		}
+	}
+
+	switch len(apps) {
+	case 0:
+		if len(bare) == 0 {
+			return nil, ErrNoPayload
+		}
+		return nil, ErrNoPlist
+	case 1:
+		l.AppDir = "Payload/" + apps[0]
+		raw := strings.ReplaceAll(l.entries[l.AppDir+"/Info.plist"].Name, "\\", "/")
+		l.rawDir = strings.TrimSuffix(raw, "/Info.plist")
+	default:
+		return nil, fmt.Errorf("%w: found %d apps in Payload (%s), expected exactly one", ErrAmbiguousPayload, len(apps), strings.Join(apps, ", "))
+	}
+
+	for _, app := range bare {
+		if !slices.Contains(apps, app) {
+			logger.Infof("ignoring 'Payload/%s' (no Info.plist)", app)
+		}
+	}
+	return l, nil
+}
+
+// ModTime returns the modification time of the app's Info.plist, used for
+// files that are added to the ipa so they don't depend on when ipapatch ran.
+func (l *ipaLayout) ModTime() time.Time {
+	return l.entries[l.AppDir+"/Info.plist"].Modified
+}
+
+// Open opens the entry with the given canonical name.
+func (l *ipaLayout) Open(name string) (io.ReadCloser, error) {
+	f, ok := l.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.Open()
+}
+
+// symlinkOn returns the entry on the way to name (name itself, or one of
+// the directories it's in) that is a symlink, if there is one.
+func (l *ipaLayout) symlinkOn(name string) (string, bool) {
+	for p := name; p != "." && p != "Payload"; p = path.Dir(p) {
+		if f, ok := l.entries[p]; ok && f.Mode()&fs.ModeSymlink != 0 {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// RawName returns the name of the entry as it is spelled in the archive.
+// Entries that don't exist yet are placed under the app directory as it is
+// spelled in the archive, so new files don't end up in a second Payload.
+func (l *ipaLayout) RawName(name string) string {
+	if f, ok := l.entries[name]; ok {
+		return f.Name
+	}
+	if rest, ok := strings.CutPrefix(name, l.AppDir+"/"); ok {
+		return l.rawDir + "/" + rest
+	}
+	return name
+}
+
+// injectAll patches the main executable and all plugins in an IPA/TIPA, and
+// edits their Info.plists, according to p. It returns the patched files to
+// write back to the ipa, target by target in the order of their paths.
+// Executables up to --mem-limit are patched in memory, bigger ones are
+// extracted to tmpdir.
+func injectAll(ctx context.Context, args Args, p *plan, tmpdir string) ([]addition, *ipaLayout, error) {
 	z, err := zip.OpenReader(args.Input)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer z.Close()
 
-	plists, err := findPlists(z.File, args.PluginsOnly)
+	layout, err := parseLayout(z.File)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	paths := make(map[string]string, len(plists))
 
-	// Build list of LC names to inject
-	var lcNames []string
-	if len(args.Dylib) == 0 {
-		lcNames = []string{"@rpath/zxPluginsInject.dylib"}
-	} else {
-		seen := make(map[string]struct{})
-		for _, dylibPath := range args.Dylib {
-			if dylibPath == "" {
-				continue
-			}
-			name := "@rpath/" + filepath.Base(dylibPath)
-			if _, ok := seen[name]; ok {
-				continue
+	plists, err := findPlists(layout, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// figure out what to do to which bundle first, so the space needed is
+	// known before any work starts
+	targets := make([]ipaTarget, 0, len(plists))
+	memLimit := uint64(max(args.MemLimit, 0)) << 20
+	var tmpNeeded uint64
+	for _, plistPath := range plists {
+		pl, err := getExecutableNames(layout, plistPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		bundle := pl.bundle(plistPath != layout.AppDir+"/Info.plist")
+		if !p.Plugins.Allows(bundle) {
+			logger.Infof("skipping plugin %s (filtered out)", pl.Executable)
+			continue
+		}
+
+		t := ipaTarget{
+			plistPath: plistPath,
+			execPath:  path.Join(path.Dir(plistPath), pl.Executable),
+			pl:        pl,
+			lcs:       p.loadCommandsFor(bundle),
+			edits:     p.editsFor(bundle),
+
+			allowEncrypted: args.AllowEncrypted,
+		}
+		if link, ok := layout.symlinkOn(t.execPath); ok && len(t.lcs) > 0 {
+			return nil, nil, fmt.Errorf("%w: the executable of %s is reached through %s", ErrSymlink, pl.Executable, link)
+		}
+		if link, ok := layout.symlinkOn(t.plistPath); ok && len(t.edits) > 0 {
+			return nil, nil, fmt.Errorf("%w: the Info.plist of %s is reached through %s", ErrSymlink, pl.Executable, link)
+		}
+		if f, ok := layout.entries[t.execPath]; ok && len(t.lcs) > 0 {
+			t.inMemory = f.UncompressedSize64 <= memLimit
+			if !t.inMemory {
+				// the extracted executable, plus the slices of fat ones
+				tmpNeeded += 2 * f.UncompressedSize64
 			}
-			seen[name] = struct{}{}
-			lcNames = append(lcNames, name)
 		}
+		targets = append(targets, t)
 	}
 
-	for _, p := range plists {
-		pl, err := getExecutableNames(z, p)
-		if err != nil {
-			return nil, err
+	hasWork := func(t ipaTarget) bool { return len(t.lcs) > 0 || len(t.edits) > 0 }
+	if !slices.ContainsFunc(targets, hasWork) && (len(p.Injections) > 0 || len(p.PlistEdits) > 0) {
+		return nil, nil, fmt.Errorf("no targets found in %s (no main app or plugins matched)", filepath.Base(args.Input))
+	}
+
+	if err = preflight(args, p, tmpdir, tmpNeeded); err != nil {
+		return nil, nil, err
+	}
+
+	// targets are patched in parallel (see --jobs), but the results are
+	// kept in the order of targets so the output doesn't depend on timing
+	w := newWorkers(args.Jobs)
+	progress.AddTargets(len(targets))
+	results := make([][]addition, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			break
 		}
+		w.Go(&wg, func() {
+			results[i], errs[i] = patchTarget(ctx, w, layout, t, tmpdir)
+			progress.TargetDone()
+		})
+	}
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err = errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+	return slices.Concat(results...), layout, nil
+}
 
-		execPath := path.Join(path.Dir(p), pl.Executable)
-		fsPath, err := extractToPath(z, tmpdir, execPath)
+// ipaTarget is a bundle in an ipa and what to do to it.
+type ipaTarget struct {
+	plistPath string
+	execPath  string
+	pl        *PlistInfo
+	lcs       []loadCommand
+	edits     []plistEdit
+	inMemory  bool
+
+	allowEncrypted bool // see --allow-encrypted
+}
+
+// patchTarget edits the Info.plist of t and injects into its executable,
+// either in memory or by extracting it to tmpdir. It returns the files to
+// write back to the ipa.
+func patchTarget(ctx context.Context, w workers, layout *ipaLayout, t ipaTarget, tmpdir string) ([]addition, error) {
+	pl := t.pl
+
+	var additions []addition
+	if len(t.edits) > 0 {
+		data, err := editPlist(layout, t.plistPath, t.edits)
 		if err != nil {
-			return nil, fmt.Errorf("error extracting %s: %w", pl.Executable, err)
+			return nil, fmt.Errorf("error editing Info.plist of %s: %w", pl.Executable, err)
 		}
+		additions = append(additions, addition{zippedPath: layout.RawName(t.plistPath), data: data})
+	}
 
-		// Logging identical style: only the executable name
-		logger.Infof("injecting into %s...", pl.Executable)
+	if len(t.lcs) == 0 {
+		return additions, nil
+	}
 
-		for _, lcName := range lcNames {
-			if err = injectLC(fsPath, pl.BundleID, lcName, tmpdir); err != nil {
-				// Option C: idempotent — if already patched, just log and continue
-				if strings.Contains(err.Error(), "already exists (already patched)") {
-					logger.Infof("%s already patched (skipping '%s')", pl.Executable, lcName)
-					continue
-				}
-				// Any other error is still fatal
-				return nil, fmt.Errorf("couldn't inject '%s' into %s: %w", lcName, pl.Executable, err)
+	var (
+		data   []byte
+		fsPath string
+		err    error
+	)
+	if t.inMemory {
+		data, err = readEntry(layout, t.execPath)
+	} else {
+		fsPath, err = extractToPath(layout, tmpdir, t.execPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error extracting %s: %w", pl.Executable, err)
+	}
+
+	what := fmt.Sprintf("%s (%s)", pl.Executable, pl.BundleID)
+	if t.inMemory {
+		err = checkEncrypted(bytes.NewReader(data), what, t.allowEncrypted)
+	} else {
+		err = checkEncryptedFile(fsPath, what, t.allowEncrypted)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Logging identical style: only the executable name
+	logger.Infof("injecting into %s...", pl.Executable)
+
+	for _, lc := range t.lcs {
+		if t.inMemory {
+			var patched []byte
+			if patched, err = injectLCBytes(ctx, w, data, pl.BundleID, lc); err == nil {
+				data = patched
 			}
+		} else {
+			err = injectLC(ctx, w, fsPath, pl.BundleID, lc, tmpdir)
+		}
+		if err != nil {
+			// Option C: idempotent — if already patched, just log and continue
+			if strings.Contains(err.Error(), "already exists (already patched)") {
+				logger.Infof("%s already patched (skipping '%s')", pl.Executable, lc.Name)
+				continue
+			}
+			// Any other error (including being interrupted) is fatal for this target
+			return nil, fmt.Errorf("couldn't inject '%s' into %s: %w", lc.Name, pl.Executable, err)
 		}
-
-		paths[fsPath] = execPath
 	}
 
-	return paths, nil
+	return append(additions, addition{
+		zippedPath: layout.RawName(t.execPath),
+		sysPath:    fsPath,
+		data:       data,
+		executable: true,
+	}), nil
 }
 
-func findPlists(files []*zip.File, pluginsOnly bool) (plists []string, err error) {
+func findPlists(l *ipaLayout, p *plan) (plists []string, err error) {
 	plists = make([]string, 0, 10)
+	pluginsOnly := p.pluginsOnly()
 
-	for _, f := range files {
-		if strings.Contains(f.Name, ".app/Watch") || strings.Contains(f.Name, ".app/WatchKit") || strings.Contains(f.Name, ".app/com.apple.WatchPlaceholder") {
-			logger.Infof("found watch app at '%s', you might want to remove that", filepath.Dir(f.Name))
+	for _, name := range l.names {
+		rel, ok := strings.CutPrefix(name, l.AppDir+"/")
+		if !ok || p.removed(rel) {
 			continue
 		}
-		if strings.HasSuffix(f.Name, ".appex/Info.plist") {
-			plists = append(plists, f.Name)
+		if strings.Contains(name, ".app/Watch") || strings.Contains(name, ".app/WatchKit") || strings.Contains(name, ".app/com.apple.WatchPlaceholder") {
+			logger.Infof("found watch app at '%s', you might want to remove that", path.Dir(name))
 			continue
 		}
-		if !pluginsOnly && strings.HasSuffix(f.Name, ".app/Info.plist") {
-			plists = append(plists, f.Name)
+		if strings.HasSuffix(name, ".appex/Info.plist") {
+			plists = append(plists, name)
+			continue
+		}
+		if !pluginsOnly && name == l.AppDir+"/Info.plist" {
+			plists = append(plists, name)
 			continue
 		}
 	}
@@ -116,34 +421,60 @@ func findPlists(files []*zip.File, pluginsOnly bool) (plists []string, err error
 		}
 		return nil, ErrNoPlist
 	}
+	// by path rather than by where they are in the ipa, so the targets are
+	// patched (and logged) in the same order however the ipa was zipped
+	slices.Sort(plists)
 	return plists, nil
 }
 
-func getExecutableNames(z *zip.ReadCloser, plistName string) (*PlistInfo, error) {
-	f, err := z.Open(plistName)
+func getExecutableNames(l *ipaLayout, plistName string) (*PlistInfo, error) {
+	contents, err := readEntry(l, plistName)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	contents, err := io.ReadAll(f)
+	var pl PlistInfo
+	_, err = plist.Unmarshal(contents, &pl)
+	return &pl, err
+}
+
+// editPlist returns the edited contents of the plist.
+func editPlist(l *ipaLayout, name string, edits []plistEdit) ([]byte, error) {
+	contents, err := readEntry(l, name)
 	if err != nil {
 		return nil, err
 	}
+	return applyPlistEdits(contents, edits)
+}
 
-	var pl PlistInfo
-	_, err = plist.Unmarshal(contents, &pl)
-	return &pl, err
+func readEntry(l *ipaLayout, name string) ([]byte, error) {
+	f, err := l.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
 }
 
-func extractToPath(z *zip.ReadCloser, dir, name string) (string, error) {
-	f, err := z.Open(name)
+func extractToPath(l *ipaLayout, dir, name string) (string, error) {
+	f, err := l.Open(name)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	output := filepath.Join(dir, filepath.Base(name))
+	// executables are extracted to where they are in the app, e.g.
+	// dir/app/PlugIns/Share.appex/Extension, since plugins may well have
+	// the same executable name as the main app or each other
+	rel, ok := strings.CutPrefix(name, l.AppDir+"/")
+	if !ok {
+		return "", fmt.Errorf("%s isn't in %s", name, l.AppDir)
+	}
+	output := filepath.Join(dir, "app", filepath.FromSlash(rel))
+	if err = os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return "", err
+	}
 	ff, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
 	if err != nil {
 		return "", err
@@ -154,31 +485,74 @@ func extractToPath(z *zip.ReadCloser, dir, name string) (string, error) {
 	return output, err
 }
 
-func appendFileToUpdater(ud *zip.Updater, path, zippedPath string) error {
-	o, err := os.Open(path)
-	if err != nil {
-		return err
+// replacementHeader returns a header for new contents of orig that keeps
+// everything installers might look at: the name, timestamps, permissions
+// (the external attributes and the creator OS they're relative to), extra
+// fields and compression method.
+func replacementHeader(orig *zip.FileHeader) *zip.FileHeader {
+	hdr := &zip.FileHeader{
+		Name:           orig.Name,
+		Comment:        orig.Comment,
+		NonUTF8:        orig.NonUTF8,
+		CreatorVersion: orig.CreatorVersion,
+		Method:         orig.Method,
+		ModifiedTime:   orig.ModifiedTime,
+		ModifiedDate:   orig.ModifiedDate,
+		ExternalAttrs:  orig.ExternalAttrs,
 	}
-	defer o.Close()
 
-	fi, err := o.Stat()
-	if err != nil {
-		return err
+	// the writer adds the zip64 and extended timestamp fields itself, the
+	// latter only if Modified is set, so only set it if the original had one
+	var hasExtTime bool
+	hdr.Extra, hasExtTime = stripExtra(orig.Extra)
+	if hasExtTime {
+		hdr.Modified = orig.Modified
 	}
-
-	return appendToUpdater(ud, zippedPath, fi, o)
+	return hdr
 }
 
-func appendToUpdater(ud *zip.Updater, zippedPath string, fi fs.FileInfo, r io.Reader) error {
+// newEntryHeader returns a header for a file that isn't in the ipa yet.
+func newEntryHeader(zippedPath string, fi fs.FileInfo, modTime time.Time) (*zip.FileHeader, error) {
 	hdr, err := zip.FileInfoHeader(fi)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	hdr.Name = zippedPath
 	hdr.Method = zip.Deflate
+	hdr.Modified = modTime
+	return hdr, nil
+}
+
+// stripExtra returns extra without the zip64 and extended timestamp fields,
+// and whether it had the latter.
+func stripExtra(extra []byte) (stripped []byte, hasExtTime bool) {
+	const (
+		zip64ExtraID   = 0x0001
+		extTimeExtraID = 0x5455
+	)
+
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:])) + 4
+		if size > len(extra) {
+			break // malformed, drop the rest
+		}
+
+		switch id {
+		case zip64ExtraID:
+		case extTimeExtraID:
+			hasExtTime = true
+		default:
+			stripped = append(stripped, extra[:size]...)
+		}
+		extra = extra[size:]
+	}
+	return stripped, hasExtTime
+}
 
-	w, err := ud.AppendHeader(hdr, zip.APPEND_MODE_OVERWRITE)
+func appendToZip(zw *zip.Writer, hdr *zip.FileHeader, r io.Reader) error {
+	w, err := zw.CreateHeader(hdr)
 	if err != nil {
 		return err
 	}
@@ -188,14 +562,44 @@ func appendToUpdater(ud *zip.Updater, zippedPath string, fi fs.FileInfo, r io.Re
 }
 
 // PatchAppBundle patches an iOS .app bundle on disk (e.g. Payload/YouTube.app),
-// mirroring IPA behavior: if no -d is supplied, it injects the embedded
-// zxPluginsInject.dylib; otherwise it uses the provided dylib(s).
+// mirroring IPA behavior: if no -d is supplied, it injects the selected
+// built-in payload (see --payload); otherwise it uses the provided dylib(s),
+// or does whatever the recipe says (see --recipe).
 // It injects into the main app binary and all .appex plugins, unless
-// --plugins-only is set, in which case it injects only into plugins.
+// --plugins-only is set (or the payload says so), in which case it injects
+// only into plugins.
 // Behavior is idempotent: if a load command already exists, it logs and skips.
-func PatchAppBundle(args Args) error {
+// If ctx is canceled it stops between files, so nothing is left half written,
+// but the bundle may be only partially patched; running it again finishes
+// the job. To patch a copy instead, see PatchAppToDir and PatchAppToIPA.
+func PatchAppBundle(ctx context.Context, args Args) error {
+	return patchAppBundle(ctx, args, false)
+}
+
+// patchAppBundle is PatchAppBundle. If cloned is set, the bundle is a copy
+// made by cloneTree whose files may be hard links to the original ones, so
+// patched executables and Info.plists are replaced instead of being
+// written to.
+func patchAppBundle(ctx context.Context, args Args, cloned bool) error {
 	appPath := args.Input
 
+	p, err := buildPlan(args)
+	if err != nil {
+		return err
+	}
+
+	for _, rm := range p.Remove {
+		logger.Infof("removing %s...", rm)
+		// removing a symlink is fine, removing what's behind one isn't
+		target := filepath.Join(appPath, filepath.FromSlash(rm))
+		if err := checkNoSymlink(appPath, filepath.Dir(target), rm); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", rm, err)
+		}
+	}
+
 	mainInfoPath := filepath.Join(appPath, "Info.plist")
 	mainHasPlist := true
 	if _, err := os.Stat(mainInfoPath); err != nil {
@@ -206,59 +610,80 @@ func PatchAppBundle(args Args) error {
 		}
 	}
 
-	// Build list of LC_LOAD_* names to inject (same as IPA)
-	var lcNames []string
-	if len(args.Dylib) == 0 {
-		lcNames = []string{"@rpath/zxPluginsInject.dylib"}
-	} else {
-		seen := make(map[string]struct{})
-		for _, dylibPath := range args.Dylib {
-			if dylibPath == "" {
-				continue
-			}
-			name := "@rpath/" + filepath.Base(dylibPath)
-			if _, ok := seen[name]; ok {
-				continue
-			}
-			seen[name] = struct{}{}
-			lcNames = append(lcNames, name)
-		}
-	}
-
 	type target struct {
+		infoPath    string
 		execPath    string
 		bundleID    string
 		displayName string
+		lcs         []loadCommand
+		edits       []plistEdit
 	}
 
 	var targets []target
 
-	// Main app target, if allowed (no --plugins-only)
-	if mainHasPlist && !args.PluginsOnly {
-		contents, err := os.ReadFile(mainInfoPath)
+	// addTarget reads the Info.plist of a bundle and adds it as a target if
+	// the plan applies to it
+	addTarget := func(infoPath string, isPlugin bool) error {
+		kind := "Info.plist"
+		if isPlugin {
+			kind = "plugin Info.plist"
+		}
+		contents, err := os.ReadFile(infoPath)
 		if err != nil {
-			return fmt.Errorf("failed to read Info.plist: %w", err)
+			return fmt.Errorf("failed to read %s at %s: %w", kind, infoPath, err)
 		}
 
 		var pl PlistInfo
 		if _, err := plist.Unmarshal(contents, &pl); err != nil {
-			return fmt.Errorf("failed to parse Info.plist: %w", err)
+			return fmt.Errorf("failed to parse %s at %s: %w", kind, infoPath, err)
 		}
 
-		binPath := filepath.Join(appPath, pl.Executable)
-		if _, err := os.Stat(binPath); err != nil {
-			return fmt.Errorf("executable not found at %s: %w", binPath, err)
+		bundle := pl.bundle(isPlugin)
+		if !p.Plugins.Allows(bundle) {
+			logger.Infof("skipping plugin %s (filtered out)", pl.Executable)
+			return nil
 		}
-
-		targets = append(targets, target{
-			execPath:    binPath,
+		if !validBundlePath(pl.Executable) {
+			return fmt.Errorf("%s at %s has an invalid CFBundleExecutable %q", kind, infoPath, pl.Executable)
+		}
+		t := target{
+			infoPath:    infoPath,
+			execPath:    filepath.Join(filepath.Dir(infoPath), pl.Executable),
 			bundleID:    pl.BundleID,
-			displayName: pl.Executable, // "YouTube"
-		})
+			displayName: pl.Executable, // e.g. "YouTube" or NotificationContentExtension
+			lcs:         p.loadCommandsFor(bundle),
+			edits:       p.editsFor(bundle),
+		}
+		if len(t.lcs) == 0 && len(t.edits) == 0 {
+			return nil
+		}
+
+		if len(t.lcs) > 0 {
+			if _, err := os.Stat(t.execPath); err != nil {
+				return fmt.Errorf("executable not found at %s: %w", t.execPath, err)
+			}
+			if err := checkNoSymlink(appPath, t.execPath, "the executable of "+pl.Executable); err != nil {
+				return err
+			}
+		}
+		if len(t.edits) > 0 {
+			if err := checkNoSymlink(appPath, infoPath, "the Info.plist of "+pl.Executable); err != nil {
+				return err
+			}
+		}
+		targets = append(targets, t)
+		return nil
+	}
+
+	// Main app target, if anything applies to it (no --plugins-only)
+	if mainHasPlist && !p.pluginsOnly() {
+		if err := addTarget(mainInfoPath, false); err != nil {
+			return err
+		}
 	}
 
 	// Walk for .appex plugins and add them as targets
-	err := filepath.WalkDir(appPath, func(p string, d fs.DirEntry, err error) error {
+	err = filepath.WalkDir(appPath, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -268,98 +693,146 @@ func PatchAppBundle(args Args) error {
 		if !strings.HasSuffix(p, ".appex/Info.plist") {
 			return nil
 		}
-
-		contents, err := os.ReadFile(p)
-		if err != nil {
-			return fmt.Errorf("failed to read plugin Info.plist at %s: %w", p, err)
-		}
-
-		var pl PlistInfo
-		if _, err := plist.Unmarshal(contents, &pl); err != nil {
-			return fmt.Errorf("failed to parse plugin Info.plist at %s: %w", p, err)
-		}
-
-		bundleDir := filepath.Dir(p)
-		binPath := filepath.Join(bundleDir, pl.Executable)
-		if _, err := os.Stat(binPath); err != nil {
-			return fmt.Errorf("plugin executable not found at %s: %w", binPath, err)
-		}
-
-		targets = append(targets, target{
-			execPath:    binPath,
-			bundleID:    pl.BundleID,
-			displayName: pl.Executable, // e.g. NotificationContentExtension
-		})
-
-		return nil
+		return addTarget(p, true)
 	})
 	if err != nil {
 		return err
 	}
 
-	if len(targets) == 0 {
+	if len(targets) == 0 && (len(p.Injections) > 0 || len(p.PlistEdits) > 0) {
 		return fmt.Errorf("no targets found in %s (no main app or plugins matched)", appPath)
 	}
 
 	// Temporary dir for fat-file rewrites
-	tmpdir, err := os.MkdirTemp("", ".ipapatch-app-*")
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-app-*")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmpdir)
 
-	// Inject into all targets (idempotent)
-	for _, t := range targets {
+	// Inject into all targets (idempotent), in parallel (see --jobs)
+	w := newWorkers(args.Jobs)
+	patchBundle := func(t target) error {
+		if len(t.edits) > 0 {
+			logger.Infof("editing Info.plist of %s...", t.displayName)
+			if cloned {
+				if err := breakLink(t.infoPath); err != nil {
+					return fmt.Errorf("couldn't copy Info.plist of %s: %w", t.displayName, err)
+				}
+			}
+			if err := editPlistInPlace(t.infoPath, t.edits); err != nil {
+				return fmt.Errorf("couldn't edit Info.plist of %s: %w", t.displayName, err)
+			}
+		}
+		if len(t.lcs) == 0 {
+			return nil
+		}
+
+		what := fmt.Sprintf("%s (%s)", t.displayName, t.bundleID)
+		if err := checkEncryptedFile(t.execPath, what, args.AllowEncrypted); err != nil {
+			return err
+		}
+
 		logger.Infof("injecting into %s...", t.displayName)
-		for _, lcName := range lcNames {
-			if err := injectLC(t.execPath, t.bundleID, lcName, tmpdir); err != nil {
+		if cloned {
+			if err := breakLink(t.execPath); err != nil {
+				return fmt.Errorf("couldn't copy %s: %w", t.displayName, err)
+			}
+		}
+		for _, lc := range t.lcs {
+			if err := injectLC(ctx, w, t.execPath, t.bundleID, lc, tmpdir); err != nil {
 				if strings.Contains(err.Error(), "already exists (already patched)") {
-					logger.Infof("%s already patched (skipping '%s')", t.displayName, lcName)
+					logger.Infof("%s already patched (skipping '%s')", t.displayName, lc.Name)
 					continue
 				}
-				return fmt.Errorf("couldn't inject '%s' into %s: %w", lcName, t.displayName, err)
+				return fmt.Errorf("couldn't inject '%s' into %s: %w", lc.Name, t.displayName, err)
 			}
 		}
+		return nil
 	}
-
-	// Copy dylib(s) into the bundle's Frameworks folder (iOS layout)
-	frameworksDir := filepath.Join(appPath, "Frameworks")
-	if err := os.MkdirAll(frameworksDir, 0755); err != nil {
-		return fmt.Errorf("failed to create Frameworks dir: %w", err)
+	progress.SetPhase("injecting")
+	progress.AddTargets(len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		w.Go(&wg, func() {
+			errs[i] = patchBundle(t)
+			progress.TargetDone()
+		})
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
 	}
 
-	if len(args.Dylib) == 0 {
-		// No custom dylib: copy embedded zxPluginsInject into Frameworks
-		zxpi, err := zxPluginsInject.Open("resources/zxPluginsInject.dylib")
-		if err != nil {
-			return fmt.Errorf("failed to open embedded zxPluginsInject.dylib: %w", err)
+	// Copy dylib(s) and framework(s) into the bundle (Frameworks folder, iOS layout)
+	progress.SetPhase("copying")
+	for _, inj := range p.Injections {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dst := filepath.Join(appPath, filepath.FromSlash(inj.Dest))
+		if err := checkNoSymlink(appPath, filepath.Dir(dst), inj.Dest); err != nil {
+			return err
+		}
+		// whatever is already there is replaced rather than written to, as
+		// it may be a symlink, or a hard link to the original (if cloned)
+		if err := os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dst, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(dst), err)
+		}
+
+		if inj.sysPath != "" {
+			if err := copyTree(inj.sysPath, dst); err != nil {
+				return fmt.Errorf("failed to copy %s -> %s: %w", inj.sysPath, dst, err)
+			}
+			continue
 		}
-		defer zxpi.Close()
 
-		dst := filepath.Join(frameworksDir, "zxPluginsInject.dylib")
+		src, _, err := inj.payload.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open embedded %s: %w", inj.payload.Name, err)
+		}
 		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 		if err != nil {
+			src.Close()
 			return fmt.Errorf("failed to create %s: %w", dst, err)
 		}
-		if _, err := io.Copy(out, zxpi); err != nil {
+		_, err = io.Copy(progress.Copying(out), src)
+		src.Close()
+		if err != nil {
 			out.Close()
 			return fmt.Errorf("failed to write %s: %w", dst, err)
 		}
 		if err := out.Close(); err != nil {
 			return fmt.Errorf("failed to close %s: %w", dst, err)
 		}
-	} else {
-		// Custom dylibs: copy all of them into Frameworks
-		for _, dylibPath := range args.Dylib {
-			if dylibPath == "" {
-				continue
-			}
-			dst := filepath.Join(frameworksDir, filepath.Base(dylibPath))
-			if err := copyfile(dylibPath, dst); err != nil {
-				return fmt.Errorf("failed to copy %s -> %s: %w", dylibPath, dst, err)
-			}
-		}
 	}
 
 	return nil
 }
+
+func editPlistInPlace(infoPath string, edits []plistEdit) error {
+	contents, err := os.ReadFile(infoPath)
+	if err != nil {
+		return err
+	}
+	contents, err = applyPlistEdits(contents, edits)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(infoPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(infoPath, contents, fi.Mode().Perm())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/STARRY-S/zip"
+)
+
+// zipFiles returns entries with the given names, as read from an archive.
+func zipFiles(names ...string) []*zip.File {
+	files := make([]*zip.File, len(names))
+	for i, name := range names {
+		files[i] = &zip.File{FileHeader: zip.FileHeader{Name: name}}
+	}
+	return files
+}
+
+func TestNormalizeEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"canonical", "Payload/A.app/Info.plist", "Payload/A.app/Info.plist"},
+		{"leading ./", "./Payload/A.app/Info.plist", "Payload/A.app/Info.plist"},
+		{"leading /", "/Payload/A.app/A", "Payload/A.app/A"},
+		{"repeated prefixes", ".//./Payload/A.app/A", "Payload/A.app/A"},
+		{"backslashes", `Payload\A.app\Info.plist`, "Payload/A.app/Info.plist"},
+		{"payload casing", "payload/A.app/A", "Payload/A.app/A"},
+		{"payload directory", "PAYLOAD/", "Payload/"},
+		{"lone payload", "payload", "Payload"},
+		{"app casing kept", "Payload/a.APP/A", "Payload/a.APP/A"},
+		{"outside payload", "./iTunesMetadata.plist", "iTunesMetadata.plist"},
+		{"payload further down", "Other/payload/A", "Other/payload/A"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeEntryName(tc.in); got != tc.want {
+				t.Fatalf("normalizeEntryName(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckEntryNames(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		in    []string
+		valid bool
+	}{
+		{"ipa", []string{"Payload/", "Payload/A.app/", "Payload/A.app/Info.plist", "Payload/A.app/A"}, true},
+		{"parent directory", []string{"Payload/A.app/../../evil"}, false},
+		{"leading parent directory", []string{"../evil"}, false},
+		{"parent directory with backslashes", []string{`Payload\A.app\..\..\evil`}, false},
+		{"dots in a name", []string{"Payload/A.app/..data", "Payload/A.app/a..b"}, true},
+		{"absolute", []string{"/etc/passwd"}, false},
+		{"absolute with backslashes", []string{`\etc\passwd`}, false},
+		{"drive letter", []string{`C:\Windows\evil`}, false},
+		{"relative drive letter", []string{"C:evil"}, false},
+		{"NUL byte", []string{"Payload/A.app/A\x00.png"}, false},
+		{"same name", []string{"Payload/A.app/A", "Payload/A.app/A"}, false},
+		{"differing by case", []string{"Payload/A.app/Assets.car", "Payload/A.app/assets.car"}, false},
+		{"payload differing by case", []string{"Payload/A.app/A", "payload/A.app/A"}, false},
+		{"leading ./", []string{"./Payload/A.app/A", "Payload/A.app/A"}, false},
+		{"backslashes", []string{`Payload\A.app\A`, "Payload/A.app/A"}, false},
+		{"file and directory", []string{"Payload/A.app/A", "Payload/A.app/A/"}, false},
+		{"repeated directory", []string{"Payload/A.app/", "Payload/A.app/"}, true},
+		{"directory differing by case", []string{"Payload/A.app/", "./payload/a.app/"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkEntryNames(zipFiles(tc.in...))
+			if !tc.valid {
+				if !errors.Is(err, ErrUnsafeEntry) {
+					t.Fatalf("checkEntryNames(%q) = %v, want %v", tc.in, err, ErrUnsafeEntry)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkEntryNames(%q): %v", tc.in, err)
+			}
+		})
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      []string
+		appDir  string
+		rawDir  string
+		wantErr error // nil if it should succeed
+	}{
+		{
+			"ipa",
+			[]string{"Payload/", "Payload/A.app/", "Payload/A.app/Info.plist", "Payload/A.app/A"},
+			"Payload/A.app", "Payload/A.app", nil,
+		},
+		{
+			"leading ./",
+			[]string{"./Payload/A.app/Info.plist", "./Payload/A.app/A"},
+			"Payload/A.app", "./Payload/A.app", nil,
+		},
+		{
+			"backslashes",
+			[]string{`Payload\A.app\Info.plist`, `Payload\A.app\A`},
+			"Payload/A.app", "Payload/A.app", nil,
+		},
+		{
+			"payload casing",
+			[]string{"payload/A.app/Info.plist", "payload/A.app/A"},
+			"Payload/A.app", "payload/A.app", nil,
+		},
+		{
+			"app extension casing",
+			[]string{"Payload/A.APP/Info.plist"},
+			"Payload/A.APP", "Payload/A.APP", nil,
+		},
+		{
+			"plugin plist",
+			[]string{"Payload/A.app/Info.plist", "Payload/A.app/PlugIns/B.appex/Info.plist"},
+			"Payload/A.app", "Payload/A.app", nil,
+		},
+		{
+			"bare app dirs",
+			[]string{"Payload/A.app/Info.plist", "Payload/B.app/", "Payload/C.app/C"},
+			"Payload/A.app", "Payload/A.app", nil,
+		},
+		{
+			"several apps",
+			[]string{"Payload/A.app/Info.plist", "Payload/B.app/Info.plist"},
+			"", "", ErrAmbiguousPayload,
+		},
+		{
+			"several apps spelled differently",
+			[]string{"./Payload/A.app/Info.plist", `payload\B.app\Info.plist`},
+			"", "", ErrAmbiguousPayload,
+		},
+		{
+			"no Info.plist",
+			[]string{"Payload/A.app/", "Payload/A.app/A"},
+			"", "", ErrNoPlist,
+		},
+		{
+			"nested Info.plist",
+			[]string{"Payload/A.app/Contents/Info.plist"},
+			"", "", ErrNoPlist,
+		},
+		{
+			"no app",
+			[]string{"Payload/", "Payload/readme.txt", "A.app/Info.plist"},
+			"", "", ErrNoPayload,
+		},
+		{"empty", nil, "", "", ErrNoPayload},
+		{
+			"unsafe name",
+			[]string{"Payload/A.app/Info.plist", "Payload/A.app/../../evil"},
+			"", "", ErrUnsafeEntry,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := parseLayout(zipFiles(tc.in...))
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("parseLayout(%q) = %v, want %v", tc.in, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLayout(%q): %v", tc.in, err)
+			}
+			if l.AppDir != tc.appDir || l.rawDir != tc.rawDir {
+				t.Fatalf("parseLayout(%q) = %q (%q in the archive), want %q (%q)", tc.in, l.AppDir, l.rawDir, tc.appDir, tc.rawDir)
+			}
+		})
+	}
+}
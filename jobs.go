@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// workers limits how many targets and slices are patched at once (see
+// --jobs). Re-signing hashes every page of an executable, so apps with lots
+// of plugins or universal binaries benefit from doing it in parallel.
+type workers chan struct{}
+
+// newWorkers returns workers for n jobs, or one per CPU if n < 1.
+func newWorkers(n int) workers {
+	if n < 1 {
+		n = runtime.NumCPU()
+	}
+	return make(workers, n)
+}
+
+// Go runs f on a new goroutine as soon as a worker is free.
+func (w workers) Go(wg *sync.WaitGroup, f func()) {
+	w <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { <-w }()
+		f()
+	}()
+}
+
+// TryGo runs f on a new goroutine if a worker is free right now, and on the
+// calling goroutine otherwise. It's for work started by work that already
+// has a worker, which could otherwise wait for itself forever.
+func (w workers) TryGo(wg *sync.WaitGroup, f func()) {
+	select {
+	case w <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-w }()
+			f()
+		}()
+	default:
+		f()
+	}
+}
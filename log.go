@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -8,16 +10,36 @@ import (
 var logger *zap.SugaredLogger
 
 func init() {
+	if err := setLogFormat("console"); err != nil {
+		panic(err)
+	}
+}
+
+// setLogFormat (re)creates the logger, format is either "console" (the
+// default, also used if format is empty) or "json".
+func setLogFormat(format string) error {
 	config := zap.NewProductionConfig()
-	config.Encoding = "console"
 	config.EncoderConfig.TimeKey = "" // omit time from logs
-	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	config.EncoderConfig.ConsoleSeparator = " "
 	config.DisableCaller = true
 	config.DisableStacktrace = true
-	l, err := config.Build()
+
+	switch format {
+	case "", "console":
+		config.Encoding = "console"
+		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		config.EncoderConfig.ConsoleSeparator = " "
+	case "json":
+		config.Encoding = "json"
+	default:
+		return fmt.Errorf("unknown log format %q (expected console or json)", format)
+	}
+
+	l, err := config.Build(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return progressCore{c}
+	}))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	logger = l.Sugar()
+	return nil
 }
@@ -1,38 +1,72 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"syscall"
 
 	"github.com/alexflint/go-arg"
 	"go.uber.org/zap/zapcore"
 )
 
-//go:embed resources/zxPluginsInject.dylib
-var zxPluginsInject embed.FS
+//go:embed resources/*.dylib
+var payloadFS embed.FS
 
 func main() {
-	var args Args
-	if err := arg.Parse(&args); err != nil {
+	cfg, err := LoadConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	args := cfg.Defaults()
+	if err = arg.Parse(&args); err != nil {
 		if errors.Is(err, arg.ErrHelp) {
 			fmt.Println(helpText)
 			return
 		} else if errors.Is(err, arg.ErrVersion) {
 			fmt.Println(args.Version())
 			return
-		} else if args.Input == "" {
-			fmt.Println(helpText)
-			fmt.Println("\nerror: --input is required")
-			return
 		}
 		logger.Fatalf("%v (see --help for usage)", err)
 	}
 
+	if err = setLogFormat(args.LogFormat); err != nil {
+		logger.Fatalf("%v (see --help for usage)", err)
+	}
+	cfg.Merge(&args)
+	if args.Compression < 0 || args.Compression > 9 {
+		logger.Fatalf("invalid --compression %d, expected 0 to 9 (see --help for usage)", args.Compression)
+	}
+
+	switch {
+	case args.Pack != nil:
+		runPack(args)
+		return
+	case args.Unpack != nil:
+		runUnpack(args)
+		return
+	case args.Inspect != nil:
+		runInspect(args)
+		return
+	}
+
+	if args.ListPayloads {
+		if err := ListPayloads(); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if args.Input == "" {
+		fmt.Println(helpText)
+		fmt.Println("\nerror: --input is required")
+		return
+	}
+
 	// Validate input exists
 	if _, err := os.Stat(args.Input); err != nil {
 		if os.IsNotExist(err) {
@@ -41,11 +75,31 @@ func main() {
 		logger.Fatalf("failed to stat input: %v", err)
 	}
 
+	// Figure out what the input is, by its contents unless told otherwise
+	var typ inputType
+	if args.InputType != "" {
+		if typ, err = parseInputType(args.InputType); err != nil {
+			logger.Fatalf("%v (see --help for usage)", err)
+		}
+		args.Input = filepath.Clean(args.Input)
+		if typ == inputApp {
+			if args.Input, err = resolveApp(args.Input); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	} else if args.Input, typ, err = detectInput(args.Input); err != nil {
+		logger.Fatal(err)
+	}
+
 	// Validate all dylib paths (if any)
 	for _, d := range args.Dylib {
 		if d == "" {
 			continue
 		}
+		d, _, err := splitScope(d)
+		if err != nil {
+			logger.Fatal(err)
+		}
 		if _, err := os.Stat(d); err != nil {
 			if os.IsNotExist(err) {
 				logger.Fatalw("path provided to -d/--dylib doesn't exist", "path", d)
@@ -54,28 +108,53 @@ func main() {
 		}
 	}
 
-	ext := strings.ToLower(filepath.Ext(args.Input))
-	switch ext {
-	case ".ipa", ".tipa":
+	if typ != inputMachO && (len(args.LoadName) > 0 || args.SignID != "") {
+		logger.Fatal("--load-name and --sign-id are only for Mach-O inputs")
+	}
+	switch typ {
+	case inputIPA:
 		runForIPA(args)
-	case ".app":
+	case inputApp:
 		runForAppBundle(args)
-	default:
-		logger.Fatalf("unsupported input type %q (expected .ipa, .tipa, or .app)", ext)
+	case inputMachO:
+		runForMachO(args)
 	}
 }
 
 func runForIPA(args Args) {
 	if args.UseZip {
-		if _, err := exec.LookPath("zip"); err != nil {
-			logger.Fatal("zip command not found in PATH, you need to install it or omit --zip (see help)")
+		logger.Info("--zip is now the default (the ipa is always rewritten without stale entries), ignoring")
+	}
+
+	if !args.InPlace && args.Output != "" && isDirOutput(args.Output) {
+		appName, err := ipaAppName(args.Input)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if !confirmOverwrite(appOutputPath(args.Output, appName), args.NoConfirm) {
+			return
 		}
+		run(PatchIPAToDir, args, "interrupted, the output was left untouched")
+		return
 	}
 
-	// ─────────────────────────────────────────────────────────────
-	// Output / inplace resolution
-	// ─────────────────────────────────────────────────────────────
+	if !resolveOutput(&args) {
+		return
+	}
+	run(Patch, args, "interrupted, the output was left untouched")
+}
 
+func runForMachO(args Args) {
+	if !resolveOutput(&args) {
+		return
+	}
+	run(PatchBinary, args, "interrupted, the output was left untouched")
+}
+
+// resolveOutput sets args.Output for inputs that are patched into a new
+// file, asking before overwriting an existing one. It returns false if the
+// user said no.
+func resolveOutput(args *Args) bool {
 	// Default to inplace when no output is specified
 	if args.Output == "" {
 		args.InPlace = true
@@ -87,21 +166,23 @@ func runForIPA(args Args) {
 	if args.InPlace {
 		logger.Info("--inplace specified, will overwrite input")
 		args.Output = args.Input
-	} else {
-		_, err := os.Stat(args.Output)
-		if err == nil {
-			if args.NoConfirm {
-				logger.Info("--output already exists, overwriting")
-			} else if !AskInteractively("--output already exists, overwrite?") {
-				return
-			}
-		}
+	} else if !confirmOverwrite(args.Output, args.NoConfirm) {
+		return false
 	}
+	return true
+}
 
-	if err := Patch(args); err != nil {
-		logger.Log(zapcore.ErrorLevel, err)
-		os.Exit(1)
+// confirmOverwrite asks before overwriting out, if it exists. It returns
+// false if the user said no.
+func confirmOverwrite(out string, noConfirm bool) bool {
+	if _, err := os.Lstat(out); err != nil {
+		return true
 	}
+	if noConfirm {
+		logger.Info("--output already exists, overwriting")
+		return true
+	}
+	return AskInteractively("--output already exists, overwrite?")
 }
 
 func runForAppBundle(args Args) {
@@ -109,12 +190,49 @@ func runForAppBundle(args Args) {
 		logger.Info("--zip has no effect for .app inputs (ignored)")
 	}
 
-	if !args.InPlace && args.Output != "" {
-		logger.Info("--output is ignored for .app inputs; patching in place")
+	if args.InPlace || args.Output == "" {
+		run(PatchAppBundle, args, "interrupted, the bundle may be partially patched (run ipapatch again to finish)")
+		return
+	}
+
+	if isIPAPath(args.Output) {
+		if !confirmOverwrite(args.Output, args.NoConfirm) {
+			return
+		}
+		run(PatchAppToIPA, args, "interrupted, the output was left untouched")
+		return
 	}
 
-	if err := PatchAppBundle(args); err != nil {
-		logger.Log(zapcore.ErrorLevel, err)
-		os.Exit(1)
+	if !confirmOverwrite(appOutputPath(args.Output, filepath.Base(args.Input)), args.NoConfirm) {
+		return
+	}
+	run(PatchAppToDir, args, "interrupted, the output was left untouched")
+}
+
+// run runs patch, canceling it on SIGINT or SIGTERM so that it can clean up
+// after itself, and exits if it fails. A second signal kills ipapatch
+// right away. Progress is reported while it runs, unless --quiet is set.
+func run(patch func(context.Context, Args) error, args Args, interrupted string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if !args.Quiet {
+		progress.Start()
+	}
+	err := patch(ctx, args)
+	canceled := ctx.Err() != nil
+	stop()
+	progress.Stop()
+	if err == nil {
+		return
+	}
+	if canceled {
+		logger.Error(interrupted)
+		os.Exit(130)
 	}
+	logger.Log(zapcore.ErrorLevel, err)
+	os.Exit(1)
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+)
+
+var ErrOrdinals = errors.New("can't renumber the dylib ordinals")
+
+// dylibLoads are the load commands that dylib ordinals count: the n-th of
+// them, in load command order, is ordinal n of binds, chained fixup
+// imports, re-exports and two-level symbols.
+var dylibLoads = []types.LoadCmd{
+	types.LC_LOAD_DYLIB,
+	types.LC_LOAD_WEAK_DYLIB,
+	types.LC_REEXPORT_DYLIB,
+	types.LC_LAZY_LOAD_DYLIB,
+	types.LC_LOAD_UPWARD_DYLIB,
+}
+
+func isDylibLoad(cmd types.LoadCmd) bool {
+	return slices.Contains(dylibLoads, cmd)
+}
+
+// shiftOrdinals renumbers the dylib ordinals in data, a thin Mach-O laid out
+// like m, for a dylib command inserted as ordinal from: every reference to
+// ordinal from or a later one is moved up by one. The tables are rewritten
+// in place, so it fails with ErrOrdinals if a new ordinal doesn't fit in
+// the bytes of the old one.
+func shiftOrdinals(m *macho.File, data []byte, from int) error {
+	s := ordinalShifter{data: data, from: uint64(from), bo: m.ByteOrder}
+	for _, l := range m.Loads {
+		var err error
+		switch l := l.(type) {
+		case *macho.DyldChainedFixups:
+			err = s.chainedImports(l.Offset, l.Size)
+		case *macho.DyldExportsTrie:
+			err = s.exportsTrie(l.Offset, l.Size)
+		case *macho.DyldInfo:
+			err = s.dyldInfo(l)
+		case *macho.DyldInfoOnly:
+			err = s.dyldInfo(&l.DyldInfo)
+		case *macho.Symtab:
+			if m.Flags.TwoLevel() {
+				err = s.symbols(l.Symoff, l.Nsyms, m.Magic == types.Magic64)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%w in the %s: %w", ErrOrdinals, l.Command(), err)
+		}
+	}
+	return nil
+}
+
+type ordinalShifter struct {
+	data []byte
+	from uint64
+	bo   binary.ByteOrder
+}
+
+// table returns the bytes at off, checking that they're in the file.
+func (s ordinalShifter) table(off, size uint32) ([]byte, error) {
+	if uint64(off)+uint64(size) > uint64(len(s.data)) {
+		return nil, fmt.Errorf("table at %#x (%d bytes) is past the end of the file", off, size)
+	}
+	return s.data[off : off+size], nil
+}
+
+func (s ordinalShifter) dyldInfo(info *macho.DyldInfo) error {
+	for _, t := range []struct{ off, size uint32 }{
+		{info.BindOff, info.BindSize},
+		{info.LazyBindOff, info.LazyBindSize},
+	} {
+		// weak binds look symbols up by name, they have no ordinals
+		if err := s.binds(t.off, t.size); err != nil {
+			return err
+		}
+	}
+	return s.exportsTrie(info.ExportOff, info.ExportSize)
+}
+
+// chainedImports renumbers the imports of LC_DYLD_CHAINED_FIXUPS, whose
+// lib_ordinal is 8 bits wide, or 16 for DYLD_CHAINED_IMPORT_ADDEND64.
+func (s ordinalShifter) chainedImports(off, size uint32) error {
+	b, err := s.table(off, size)
+	if err != nil || size == 0 {
+		return err
+	}
+	if len(b) < 28 {
+		return errors.New("truncated header")
+	}
+	importsOff := uint64(s.bo.Uint32(b[8:]))
+	count := uint64(s.bo.Uint32(b[16:]))
+
+	var entry, bits uint64
+	switch format := s.bo.Uint32(b[20:]); format {
+	case 1: // DYLD_CHAINED_IMPORT
+		entry, bits = 4, 8
+	case 2: // DYLD_CHAINED_IMPORT_ADDEND
+		entry, bits = 8, 8
+	case 3: // DYLD_CHAINED_IMPORT_ADDEND64
+		entry, bits = 16, 16
+	default:
+		return fmt.Errorf("unknown imports format %d", format)
+	}
+	if importsOff+count*entry > uint64(len(b)) {
+		return errors.New("imports past the end of the table")
+	}
+
+	mask := uint64(1)<<bits - 1
+	special := mask - 0xf // the top 16 values are BIND_SPECIAL_DYLIB_*
+	for i := range count {
+		e := b[importsOff+i*entry:]
+		var v uint64
+		if bits == 16 {
+			v = s.bo.Uint64(e)
+		} else {
+			v = uint64(s.bo.Uint32(e))
+		}
+		ord := v & mask
+		if ord == 0 || ord >= special || ord < s.from {
+			continue
+		}
+		if ord+1 >= special {
+			return fmt.Errorf("ordinal %d is the largest that fits", ord)
+		}
+		v = v&^mask | (ord + 1)
+		if bits == 16 {
+			s.bo.PutUint64(e, v)
+		} else {
+			s.bo.PutUint32(e, uint32(v))
+		}
+	}
+	return nil
+}
+
+// binds renumbers the BIND_OPCODE_SET_DYLIB_ORDINAL_* opcodes of a bind or
+// lazy bind stream.
+func (s ordinalShifter) binds(off, size uint32) error {
+	b, err := s.table(off, size)
+	if err != nil {
+		return err
+	}
+
+	for p := 0; p < len(b); {
+		op, imm := b[p]&types.BIND_OPCODE_MASK, b[p]&types.BIND_IMMEDIATE_MASK
+		p++
+		switch op {
+		case types.BIND_OPCODE_SET_DYLIB_ORDINAL_IMM:
+			if uint64(imm) >= s.from {
+				if imm == types.BIND_IMMEDIATE_MASK {
+					return fmt.Errorf("ordinal %d is the largest that fits", imm)
+				}
+				b[p-1]++
+			}
+		case types.BIND_OPCODE_SET_DYLIB_ORDINAL_ULEB:
+			ord, n, err := readULEB(b, p)
+			if err != nil {
+				return err
+			}
+			if ord >= s.from {
+				if err = putULEB(b[p:p+n], ord+1); err != nil {
+					return err
+				}
+			}
+			p += n
+		case types.BIND_OPCODE_SET_SYMBOL_TRAILING_FLAGS_IMM:
+			end := bytes.IndexByte(b[p:], 0)
+			if end < 0 {
+				return errors.New("unterminated symbol name")
+			}
+			p += end + 1
+		case types.BIND_OPCODE_SET_ADDEND_SLEB,
+			types.BIND_OPCODE_SET_SEGMENT_AND_OFFSET_ULEB,
+			types.BIND_OPCODE_ADD_ADDR_ULEB,
+			types.BIND_OPCODE_DO_BIND_ADD_ADDR_ULEB:
+			if p, err = skipLEB(b, p); err != nil {
+				return err
+			}
+		case types.BIND_OPCODE_DO_BIND_ULEB_TIMES_SKIPPING_ULEB:
+			if p, err = skipLEB(b, p); err == nil {
+				p, err = skipLEB(b, p)
+			}
+			if err != nil {
+				return err
+			}
+		case types.BIND_OPCODE_THREADED:
+			if imm == types.BIND_SUBOPCODE_THREADED_SET_BIND_ORDINAL_TABLE_SIZE_ULEB {
+				if p, err = skipLEB(b, p); err != nil {
+					return err
+				}
+			}
+		case types.BIND_OPCODE_DONE,
+			types.BIND_OPCODE_SET_DYLIB_SPECIAL_IMM,
+			types.BIND_OPCODE_SET_TYPE_IMM,
+			types.BIND_OPCODE_DO_BIND,
+			types.BIND_OPCODE_DO_BIND_ADD_ADDR_IMM_SCALED:
+			// nothing follows the opcode
+		default:
+			return fmt.Errorf("unknown bind opcode %#x at %#x", op, int(off)+p-1)
+		}
+	}
+	return nil
+}
+
+// exportsTrie renumbers the dylibs that re-exported symbols come from.
+func (s ordinalShifter) exportsTrie(off, size uint32) error {
+	b, err := s.table(off, size)
+	if err != nil || size == 0 {
+		return err
+	}
+
+	seen := make(map[int]bool)
+	pending := []int{0}
+	for len(pending) > 0 {
+		node := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+
+		infoSize, n, err := readULEB(b, node)
+		if err != nil {
+			return err
+		}
+		if infoSize > uint64(len(b)) {
+			return errors.New("truncated trie")
+		}
+		p := node + n
+		children := p + int(infoSize)
+		if infoSize > 0 {
+			flags, n, err := readULEB(b, p)
+			if err != nil {
+				return err
+			}
+			if types.ExportFlag(flags)&types.EXPORT_SYMBOL_FLAGS_REEXPORT != 0 {
+				ord, n2, err := readULEB(b, p+n)
+				if err != nil {
+					return err
+				}
+				if ord >= s.from {
+					if err = putULEB(b[p+n:p+n+n2], ord+1); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if children >= len(b) {
+			return errors.New("truncated trie")
+		}
+		count := int(b[children])
+		p = children + 1
+		for range count {
+			end := bytes.IndexByte(b[p:], 0)
+			if end < 0 {
+				return errors.New("unterminated edge")
+			}
+			child, n, err := readULEB(b, p+end+1)
+			if err != nil {
+				return err
+			}
+			p += end + 1 + n
+			if child >= uint64(len(b)) {
+				return errors.New("child past the end of the trie")
+			}
+			pending = append(pending, int(child))
+		}
+	}
+	return nil
+}
+
+// symbols renumbers the library ordinals in the n_desc of the undefined
+// symbols of a two-level namespace image.
+func (s ordinalShifter) symbols(off, count uint32, is64 bool) error {
+	entry := uint32(12) // nlist
+	if is64 {
+		entry = 16 // nlist_64
+	}
+	b, err := s.table(off, count*entry)
+	if err != nil {
+		return err
+	}
+
+	for i := range count {
+		e := b[i*entry:]
+		ntype := types.NType(e[4])
+		undefined := ntype&types.N_TYPE == types.N_UNDF
+		if is64 {
+			undefined = undefined && s.bo.Uint64(e[8:]) == 0 // not a common symbol
+		} else {
+			undefined = undefined && s.bo.Uint32(e[8:]) == 0
+		}
+		if ntype&types.N_STAB != 0 || !(undefined || ntype&types.N_TYPE == types.N_PBUD) {
+			continue
+		}
+
+		desc := s.bo.Uint16(e[6:])
+		ord := uint64(desc >> 8)
+		if ord == 0 || ord > 0xfd || ord < s.from { // 0xfe and 0xff are special
+			continue
+		}
+		if ord == 0xfd {
+			return fmt.Errorf("ordinal %d is the largest that fits", ord)
+		}
+		s.bo.PutUint16(e[6:], desc+0x100)
+	}
+	return nil
+}
+
+func readULEB(b []byte, p int) (v uint64, n int, err error) {
+	for shift := 0; p+n < len(b); shift += 7 {
+		c := b[p+n]
+		n++
+		if shift < 64 {
+			v |= uint64(c&0x7f) << shift
+		}
+		if c&0x80 == 0 {
+			return v, n, nil
+		}
+	}
+	return 0, 0, errors.New("truncated uleb128")
+}
+
+func skipLEB(b []byte, p int) (int, error) {
+	_, n, err := readULEB(b, p)
+	return p + n, err
+}
+
+// putULEB encodes v into all of b, padding it with continuation bytes: the
+// tables can't grow, so v has to fit in the bytes of the old value.
+func putULEB(b []byte, v uint64) error {
+	if len(b) < 10 && v>>(7*len(b)) != 0 {
+		return fmt.Errorf("ordinal %d doesn't fit in %d bytes", v, len(b))
+	}
+	for i := range b {
+		b[i] = byte(v&0x7f) | 0x80
+		v >>= 7
+	}
+	b[len(b)-1] &^= 0x80
+	return nil
+}
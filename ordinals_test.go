@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestPutULEB(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		v    uint64
+		want []byte // nil if it doesn't fit
+	}{
+		{"one byte", 1, 5, []byte{0x05}},
+		{"largest one byte", 1, 127, []byte{0x7f}},
+		{"too large for one byte", 1, 128, nil},
+		{"padded", 2, 5, []byte{0x85, 0x00}},
+		{"two bytes", 2, 128, []byte{0x80, 0x01}},
+		{"padded two bytes", 3, 200, []byte{0xc8, 0x81, 0x00}},
+		{"too large for two bytes", 2, 1 << 14, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := make([]byte, tc.size)
+			err := putULEB(b, tc.v)
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("putULEB(%d bytes, %d) = % x, want an error", tc.size, tc.v, b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("putULEB(%d bytes, %d): %v", tc.size, tc.v, err)
+			}
+			if !bytes.Equal(b, tc.want) {
+				t.Fatalf("putULEB(%d bytes, %d) = % x, want % x", tc.size, tc.v, b, tc.want)
+			}
+			if v, n, err := readULEB(b, 0); err != nil || v != tc.v || n != tc.size {
+				t.Fatalf("readULEB(% x) = %d, %d, %v, want %d, %d", b, v, n, err, tc.v, tc.size)
+			}
+		})
+	}
+}
+
+func TestShiftBinds(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []byte // nil if it should fail
+	}{
+		{"ordinal before from", []byte{0x11, 0x90, 0x00}, []byte{0x11, 0x90, 0x00}},
+		{"imm ordinal", []byte{0x12, 0x90}, []byte{0x13, 0x90}},
+		{"imm ordinal 14", []byte{0x1e}, []byte{0x1f}},
+		{"imm ordinal 15", []byte{0x1f}, nil},
+		{"uleb ordinal", []byte{0x20, 0x14, 0x90}, []byte{0x20, 0x15, 0x90}},
+		{"uleb ordinal 127", []byte{0x20, 0x7f}, nil},
+		{"padded uleb ordinal 127", []byte{0x20, 0xff, 0x00}, []byte{0x20, 0x80, 0x01}},
+		{"special ordinal", []byte{0x3e, 0x90}, []byte{0x3e, 0x90}},
+		{"symbol name", []byte{0x40, '_', 0x12, 0x00, 0x12}, []byte{0x40, '_', 0x12, 0x00, 0x13}},
+		{"uleb operands", []byte{0x72, 0x90, 0x01, 0x12, 0xc0, 0x92, 0x01, 0x02, 0x12}, []byte{0x72, 0x90, 0x01, 0x13, 0xc0, 0x92, 0x01, 0x02, 0x13}},
+		{"lazy binds", []byte{0x12, 0x90, 0x00, 0x00, 0x13, 0x90, 0x00}, []byte{0x13, 0x90, 0x00, 0x00, 0x14, 0x90, 0x00}},
+		{"truncated uleb", []byte{0x20, 0x80}, nil},
+		{"unknown opcode", []byte{0xe0}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := slices.Clone(tc.in)
+			s := ordinalShifter{data: b, from: 2, bo: binary.LittleEndian}
+			err := s.binds(0, uint32(len(b)))
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("binds(% x) = % x, want an error", tc.in, b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("binds(% x): %v", tc.in, err)
+			}
+			if !bytes.Equal(b, tc.want) {
+				t.Fatalf("binds(% x) = % x, want % x", tc.in, b, tc.want)
+			}
+		})
+	}
+}
+
+// chainedFixups returns a dyld_chained_fixups_header followed by imports,
+// each of size bytes.
+func chainedFixups(format uint32, size int, imports ...uint64) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 0) // fixups_version
+	b = binary.LittleEndian.AppendUint32(b, 0)    // starts_offset
+	b = binary.LittleEndian.AppendUint32(b, 28)   // imports_offset
+	b = binary.LittleEndian.AppendUint32(b, 0)    // symbols_offset
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(imports)))
+	b = binary.LittleEndian.AppendUint32(b, format)
+	b = binary.LittleEndian.AppendUint32(b, 0) // symbols_format
+	for _, imp := range imports {
+		e := make([]byte, size)
+		if size == 4 {
+			binary.LittleEndian.PutUint32(e, uint32(imp))
+		} else {
+			binary.LittleEndian.PutUint64(e, imp)
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+func TestShiftChainedImports(t *testing.T) {
+	const weak8 = 1 << 8     // weak_import of DYLD_CHAINED_IMPORT(_ADDEND)
+	const name8 = 0x123 << 9 // name_offset
+	const weak16 = 1 << 16   // weak_import of DYLD_CHAINED_IMPORT_ADDEND64
+	const name16 = 0x123 << 32
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []byte // nil if it should fail
+	}{
+		{
+			"import",
+			chainedFixups(1, 4, 1|name8, 2|weak8|name8, 0|name8),
+			chainedFixups(1, 4, 1|name8, 3|weak8|name8, 0|name8),
+		},
+		{
+			"special ordinals",
+			chainedFixups(1, 4, 0xff, 0xfe|weak8, 0xfd, 0xf0),
+			chainedFixups(1, 4, 0xff, 0xfe|weak8, 0xfd, 0xf0),
+		},
+		{
+			"largest 8-bit ordinal",
+			chainedFixups(1, 4, 0xee),
+			chainedFixups(1, 4, 0xef),
+		},
+		{"ordinal 0xef", chainedFixups(1, 4, 0xef), nil},
+		{
+			"import with addend",
+			chainedFixups(2, 8, 0xffff_fff0<<32|2|name8),
+			chainedFixups(2, 8, 0xffff_fff0<<32|3|name8),
+		},
+		{
+			"import with 64-bit addend",
+			chainedFixups(3, 16, 0x100|weak16|name16, 0xfffe, 1),
+			chainedFixups(3, 16, 0x101|weak16|name16, 0xfffe, 1),
+		},
+		{"ordinal 0xffef", chainedFixups(3, 16, 0xffef), nil},
+		{"unknown format", chainedFixups(4, 4, 2), nil},
+		{"imports past the end", chainedFixups(1, 4, 2)[:30], nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := slices.Clone(tc.in)
+			s := ordinalShifter{data: b, from: 2, bo: binary.LittleEndian}
+			err := s.chainedImports(0, uint32(len(b)))
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("chainedImports(% x) = % x, want an error", tc.in, b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chainedImports(% x): %v", tc.in, err)
+			}
+			if !bytes.Equal(b, tc.want) {
+				t.Fatalf("chainedImports(% x) = % x, want % x", tc.in, b, tc.want)
+			}
+		})
+	}
+}
+
+type nlist struct {
+	typ   uint8
+	desc  uint16
+	value uint64
+}
+
+// nlists returns a symbol table of nlist_64 entries, or nlist ones if is64
+// isn't set.
+func nlists(is64 bool, syms ...nlist) []byte {
+	var b []byte
+	for _, s := range syms {
+		b = binary.LittleEndian.AppendUint32(b, 0) // n_strx
+		b = append(b, s.typ, 0)                    // n_type, n_sect
+		b = binary.LittleEndian.AppendUint16(b, s.desc)
+		if is64 {
+			b = binary.LittleEndian.AppendUint64(b, s.value)
+		} else {
+			b = binary.LittleEndian.AppendUint32(b, uint32(s.value))
+		}
+	}
+	return b
+}
+
+func TestShiftSymbols(t *testing.T) {
+	const (
+		undf = 0x01 // N_UNDF | N_EXT
+		sect = 0x0f // N_SECT | N_EXT
+		pbud = 0x0d // N_PBUD | N_EXT
+		stab = 0x24 // N_FUN
+	)
+	for _, tc := range []struct {
+		name string
+		is64 bool
+		in   []nlist
+		want []nlist // nil if it should fail
+	}{
+		{
+			"undefined",
+			true,
+			[]nlist{{undf, 0x0100, 0}, {undf, 0x0200, 0}, {undf, 0x0310, 0}},
+			[]nlist{{undf, 0x0100, 0}, {undf, 0x0300, 0}, {undf, 0x0410, 0}},
+		},
+		{
+			"special ordinals",
+			true,
+			[]nlist{{undf, 0x0000, 0}, {undf, 0xfe00, 0}, {undf, 0xff00, 0}},
+			[]nlist{{undf, 0x0000, 0}, {undf, 0xfe00, 0}, {undf, 0xff00, 0}},
+		},
+		{
+			"largest ordinal",
+			true,
+			[]nlist{{undf, 0xfc00, 0}},
+			[]nlist{{undf, 0xfd00, 0}},
+		},
+		{"ordinal 0xfd", true, []nlist{{undf, 0xfd00, 0}}, nil},
+		{
+			"not undefined",
+			true,
+			[]nlist{{sect, 0x0200, 0x1000}, {undf, 0x0200, 8}, {stab, 0x0200, 0}},
+			[]nlist{{sect, 0x0200, 0x1000}, {undf, 0x0200, 8}, {stab, 0x0200, 0}},
+		},
+		{
+			"prebound",
+			true,
+			[]nlist{{pbud, 0x0200, 0x1000}},
+			[]nlist{{pbud, 0x0300, 0x1000}},
+		},
+		{
+			"32-bit",
+			false,
+			[]nlist{{undf, 0x0200, 0}, {sect, 0x0200, 0x1000}},
+			[]nlist{{undf, 0x0300, 0}, {sect, 0x0200, 0x1000}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := nlists(tc.is64, tc.in...)
+			s := ordinalShifter{data: b, from: 2, bo: binary.LittleEndian}
+			err := s.symbols(0, uint32(len(tc.in)), tc.is64)
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("symbols(%v) succeeded, want an error", tc.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("symbols(%v): %v", tc.in, err)
+			}
+			if want := nlists(tc.is64, tc.want...); !bytes.Equal(b, want) {
+				t.Fatalf("symbols(%v) = % x, want % x", tc.in, b, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runPack(args Args) {
+	if args.Pack.App != "" {
+		args.Input = args.Pack.App
+	}
+	if args.Input == "" {
+		logger.Fatal("pack needs a .app to package (see --help for usage)")
+	}
+
+	input, typ, err := detectInput(args.Input)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if typ != inputApp {
+		logger.Fatalf("%s isn't a .app or a Payload directory", args.Input)
+	}
+	args.Input = input
+
+	if args.Output == "" {
+		args.Output = strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)) + ".ipa"
+	}
+	if !confirmOverwrite(args.Output, args.NoConfirm) {
+		return
+	}
+	run(Pack, args, "interrupted, the output was left untouched")
+}
+
+func runUnpack(args Args) {
+	if args.Unpack.IPA != "" {
+		args.Input = args.Unpack.IPA
+	}
+	if args.Input == "" {
+		logger.Fatal("unpack needs an ipa to extract (see --help for usage)")
+	}
+
+	input, typ, err := detectInput(args.Input)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if typ != inputIPA {
+		logger.Fatalf("%s isn't an ipa", args.Input)
+	}
+	args.Input = input
+
+	if args.Output == "" {
+		args.Output = strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	}
+	if !confirmOverwrite(args.Output, args.NoConfirm) {
+		return
+	}
+	run(Unpack, args, "interrupted, the output was left untouched")
+}
+
+// Pack packages the .app at args.Input as the ipa args.Output.
+func Pack(ctx context.Context, args Args) error {
+	if err := checkNotNested(args.Input, args.Output); err != nil {
+		return err
+	}
+	wo, err := packOptions(args, filepath.Join(args.Input, "Info.plist"))
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("packaging %s...", filepath.Base(args.Input))
+	return writeIPA(ctx, args.Input, args.Output, wo)
+}
+
+// Unpack extracts the ipa at args.Input to the directory args.Output, or
+// only its app if args.Output is named *.app.
+func Unpack(ctx context.Context, args Args) error {
+	dst := filepath.Clean(args.Output)
+	appOnly := strings.EqualFold(filepath.Ext(dst), ".app")
+	if err := checkNotNested(args.Input, dst); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".ipapatch-out-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	logger.Infof("extracting %s...", filepath.Base(args.Input))
+	out := filepath.Join(tmp, filepath.Base(dst))
+	if err = unpackIPA(ctx, args.Input, out, appOnly); err != nil {
+		return err
+	}
+	return replaceDir(out, dst)
+}
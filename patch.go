@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/STARRY-S/zip"
 )
 
 // Patch patches the executable and all plugins in an IPA/TIPA.
-func Patch(args Args) error {
-	tmpdir, err := os.MkdirTemp(".", ".ipapatch-*")
+// If ctx is canceled, it stops as soon as possible and cleans up after
+// itself; the output is only ever replaced once the new ipa is complete.
+func Patch(ctx context.Context, args Args) error {
+	// "" means $TMPDIR (or the system temp dir)
+	tmpdir, err := os.MkdirTemp(args.TmpDir, ".ipapatch-*")
 	if err != nil {
 		return err
 	}
@@ -21,86 +31,401 @@ func Patch(args Args) error {
 
 	//
 
+	p, err := buildPlan(args)
+	if err != nil {
+		return err
+	}
+
 	logger.Info("extracting and injecting...")
-	paths, err := injectAll(args, tmpdir)
+	progress.SetPhase("injecting")
+	additions, layout, err := injectAll(ctx, args, p, tmpdir)
 	if err != nil {
 		return fmt.Errorf("error injecting: %w", err)
 	}
 
-	if args.Output != args.Input {
-		logger.Info("copying input to output...")
-		if err = copyfile(args.Input, args.Output); err != nil {
-			return fmt.Errorf("failed to copy input to output: %w", err)
+	// Everything that gets written to the new ipa: the patched executables
+	// and plists first, then the dylib(s) and framework(s) for the
+	// Frameworks folder.
+	slices.SortFunc(additions, func(a, b addition) int {
+		return strings.Compare(a.zippedPath, b.zippedPath)
+	})
+	for _, inj := range p.Injections {
+		a, err := injectionAdditions(layout, inj)
+		if err != nil {
+			return err
 		}
+		additions = append(additions, a...)
+	}
+	removed := func(name string) bool {
+		rel, ok := strings.CutPrefix(normalizeEntryName(name), layout.AppDir+"/")
+		return ok && p.removed(rel)
+	}
+	for _, rm := range p.Remove {
+		logger.Infof("removing %s...", rm)
 	}
 
-	var appName string
-	if args.UseZip {
-		zipArgs := make([]string, 0, len(paths)+2)
-		zipArgs = append(zipArgs, "-d", args.Output)
-		for _, val := range paths {
-			zipArgs = append(zipArgs, val)
-		}
-		appName = strings.Split(zipArgs[2], "/")[1]
-		if err = exec.Command("zip", zipArgs...).Run(); err != nil {
-			return fmt.Errorf("error deleting from zipfile: %w", err)
-		}
-	} else {
-		for _, val := range paths {
-			appName = strings.Split(val, "/")[1] // yeah i couldnt figure out another way to do this lmao
-			break
-		}
+	wo := writeOptions{ModTime: layout.ModTime(), Level: args.Compression}
+	epoch, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if ok {
+		logger.Infof("SOURCE_DATE_EPOCH is set, using %s for all written files", epoch.Format(time.RFC3339))
+		args.Reproducible = true
+		wo.ModTime = epoch
+		wo.ForceModTime = true
 	}
+	wo.NormalizeMode = args.Reproducible
 
 	//
 
-	logger.Info("adding files back to ipa...")
+	logger.Info("rewriting ipa...")
 
-	o, err := os.OpenFile(args.Output, os.O_RDWR, 0)
+	z, err := zip.OpenReader(args.Input)
 	if err != nil {
 		return err
 	}
-	defer o.Close()
+	defer z.Close()
 
-	ud, err := zip.NewUpdater(o)
+	// the new ipa is written next to the output and renamed over it at the
+	// end, which also makes --inplace safe (the input is still being read)
+	o, err := os.CreateTemp(filepath.Dir(args.Output), ".ipapatch-out-*")
 	if err != nil {
 		return err
 	}
-	defer ud.Close()
+	defer os.Remove(o.Name()) // no-op after a successful rename
+	defer o.Close()
+	if err = o.Chmod(0644); err != nil {
+		return err
+	}
+
+	progress.SetPhase("writing")
+	if fi, err := os.Stat(args.Input); err == nil {
+		progress.SetWriteTotal(fi.Size()) // close enough, most entries are copied as-is
+	}
+	zw := newZipWriter(progress.Writing(o), wo.Level)
+	if err = writeEntries(ctx, zw, z.File, additions, removed, wo); err != nil {
+		return err
+	}
+
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = o.Close(); err != nil {
+		return err
+	}
+	if err = z.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(o.Name(), args.Output)
+}
+
+// addition is a file to be written to the new ipa, either from disk, from
+// memory or from a built-in payload.
+type addition struct {
+	zippedPath string // as spelled in the archive
+	sysPath    string
+	data       []byte
+	payload    *Payload
+	executable bool // a dylib, as opposed to e.g. a framework's Info.plist
+	symlink    bool // data is the target of a symlink
+}
 
-	for sysPath, zippedPath := range paths {
-		if err = appendFileToUpdater(ud, sysPath, zippedPath); err != nil {
+// injectionAdditions returns the files to add to the ipa for inj: the
+// dylib itself, or every file of a framework.
+func injectionAdditions(layout *ipaLayout, inj injection) ([]addition, error) {
+	dest := path.Join(layout.AppDir, inj.Dest)
+	if link, ok := layout.symlinkOn(path.Dir(dest)); ok {
+		return nil, fmt.Errorf("%w: %s is reached through %s", ErrSymlink, inj.Dest, link)
+	}
+	if inj.payload != nil {
+		return []addition{{zippedPath: layout.RawName(dest), payload: inj.payload, executable: true}}, nil
+	}
+
+	fi, err := os.Stat(inj.sysPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []addition{{zippedPath: layout.RawName(dest), sysPath: inj.sysPath, executable: true}}, nil
+	}
+
+	// symlinks in frameworks (e.g. Versions/Current) are kept as such
+	var additions []addition
+	err = filepath.WalkDir(inj.sysPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(inj.sysPath, p)
+		if err != nil {
 			return err
 		}
+		a := addition{zippedPath: layout.RawName(path.Join(dest, filepath.ToSlash(rel)))}
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			a.data, a.symlink = []byte(link), true
+		} else {
+			a.sysPath = p
+		}
+		additions = append(additions, a)
+		return nil
+	})
+	return additions, err
+}
+
+func (a addition) open() (io.ReadCloser, fs.FileInfo, error) {
+	if a.payload != nil {
+		return a.payload.Open()
+	}
+	if a.sysPath == "" {
+		mode := normalizedMode(0, a.executable)
+		if a.symlink {
+			mode = normalizedMode(fs.ModeSymlink, false)
+		}
+		return io.NopCloser(bytes.NewReader(a.data)), dataInfo{path.Base(a.zippedPath), len(a.data), mode}, nil
+	}
+
+	f, err := os.Open(a.sysPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// dataInfo is the fs.FileInfo of an addition from memory.
+type dataInfo struct {
+	name string
+	size int
+	mode fs.FileMode
+}
+
+func (i dataInfo) Name() string {
+	return i.name
+}
+
+func (i dataInfo) Size() int64 {
+	return int64(i.size)
+}
+
+func (i dataInfo) Mode() fs.FileMode {
+	return i.mode
+}
+
+func (dataInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (dataInfo) IsDir() bool {
+	return false
+}
+
+func (dataInfo) Sys() any {
+	return nil
+}
+
+// writeOptions controls the metadata of the files ipapatch writes to an ipa.
+type writeOptions struct {
+	ModTime       time.Time // for added files
+	ForceModTime  bool      // use ModTime for replaced files too
+	NormalizeMode bool      // 0755 or 0644 for added files instead of their mode on disk
+	Level         int       // compression level for added files, 0 stores them
+}
+
+// method returns the compression method for added files.
+func (wo writeOptions) method() uint16 {
+	if wo.Level == 0 {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// newZipWriter returns a zip writer compressing at level (1 to 9, see
+// --compression). Files to store uncompressed need zip.Store as their
+// method, see writeOptions.method.
+func newZipWriter(w io.Writer, level int) *zip.Writer {
+	zw := zip.NewWriter(w)
+	if level != defaultCompression {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+	return zw
+}
+
+// sourceDateEpoch returns the time in $SOURCE_DATE_EPOCH, if it's set.
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, bool, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", v, err)
 	}
+	return time.Unix(secs, 0).UTC(), true, nil
+}
+
+// writeEntries writes every entry in files to zw in their original order.
+// Entries that aren't replaced by one of additions are copied as-is
+// (without recompressing them); replaced ones are written in their
+// original position, keeping their metadata (see replacementHeader).
+// Additions that don't replace anything are appended at the end, in
+// order, with the metadata from wo. Entries for which remove returns true
+// are left out. It stops with ctx.Err() once ctx is canceled.
+//
+// Leaving the stale entries out instead of overwriting them later keeps
+// the central directory free of duplicates, which some signing tools
+// choke on.
+func writeEntries(ctx context.Context, zw *zip.Writer, files []*zip.File, additions []addition, remove func(name string) bool, wo writeOptions) error {
+	pending := make(map[string]addition, len(additions))
+	for _, a := range additions {
+		pending[a.zippedPath] = a
+	}
+
+	logger.Info("adding files back to ipa...")
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if remove(f.Name) {
+			continue
+		}
 
-	// Add dylib(s) back into the IPA's Frameworks folder
-	if len(args.Dylib) > 0 {
-		for _, dylibPath := range args.Dylib {
-			if dylibPath == "" {
-				continue
+		a, ok := pending[f.Name]
+		if !ok {
+			if err := zw.Copy(f); err != nil {
+				return fmt.Errorf("error copying %s: %w", f.Name, err)
 			}
-			zippedPath := fmt.Sprintf("Payload/%s/Frameworks/%s", appName, filepath.Base(dylibPath))
-			if err := appendFileToUpdater(ud, dylibPath, zippedPath); err != nil {
-				return err
+			continue
+		}
+		delete(pending, f.Name)
+
+		r, fi, err := a.open()
+		if err != nil {
+			return err
+		}
+		hdr := replacementHeader(&f.FileHeader)
+		if wo.ForceModTime {
+			hdr.Modified = wo.ModTime
+		}
+		if f.Mode()&fs.ModeSymlink != fi.Mode()&fs.ModeSymlink {
+			// a symlink replaced by a file, or the other way around
+			hdr.SetMode(normalizedMode(fi.Mode(), a.executable))
+		}
+		err = appendToZip(zw, hdr, ctxReader{ctx, r})
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", f.Name, err)
+		}
+	}
+
+	for _, a := range additions {
+		if _, ok := pending[a.zippedPath]; !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r, fi, err := a.open()
+		if err != nil {
+			return err
+		}
+		hdr, err := newEntryHeader(a.zippedPath, fi, wo.ModTime)
+		if err == nil {
+			hdr.Method = wo.method()
+			if wo.NormalizeMode {
+				hdr.SetMode(normalizedMode(fi.Mode(), a.executable))
 			}
+			err = appendToZip(zw, hdr, ctxReader{ctx, r})
 		}
-		return nil
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", a.zippedPath, err)
+		}
+		delete(pending, a.zippedPath)
+	}
+	return nil
+}
+
+// ctxReader stops reading once ctx is canceled, so that writing a big file
+// doesn't delay cancellation.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return r.r.Read(p)
+}
 
-	// No custom dylib: use embedded zxPluginsInject.dylib
-	zxpi, err := zxPluginsInject.Open("resources/zxPluginsInject.dylib")
+func normalizedMode(mode fs.FileMode, executable bool) fs.FileMode {
+	if mode&fs.ModeSymlink != 0 {
+		return fs.ModeSymlink | 0755
+	}
+	if executable || mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// copyTree copies a file, or a directory recursively, keeping the
+// executable bit of files and symlinks as such.
+func copyTree(from, to string) error {
+	fi, err := os.Stat(from)
 	if err != nil {
 		return err
 	}
-	defer zxpi.Close()
+	if !fi.IsDir() {
+		return copyfile(from, to)
+	}
+
+	return filepath.WalkDir(from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(to, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dst, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dst)
+		}
 
-	return appendToUpdater(
-		ud,
-		fmt.Sprintf("Payload/%s/Frameworks/zxPluginsInject.dylib", appName),
-		zxPluginsInjectInfo{},
-		zxpi,
-	)
+		if err = copyfile(p, dst); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(dst, normalizedMode(info.Mode(), false))
+	})
 }
 
 func copyfile(from, to string) error {
@@ -116,6 +441,6 @@ func copyfile(from, to string) error {
 	}
 	defer f2.Close()
 
-	_, err = io.Copy(f2, f1)
+	_, err = io.Copy(progress.Copying(f2), f1)
 	return err
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+)
+
+// Payload is a dylib built into ipapatch, selected with --payload.
+type Payload struct {
+	Name     string // as passed to --payload
+	File     string // inside payloadFS
+	LoadName string // name in the injected load command
+	LoadCmd  types.LoadCmd
+	Dest     string     // where it's placed, relative to the .app
+	Targets  TargetRule // which binaries get the load command
+
+	manifest func() (*PayloadManifest, error)
+}
+
+// payloads is the registry of built-in payloads, the first one is the default.
+// Forks can bundle more by dropping them in resources/ and adding them here.
+var payloads = []*Payload{
+	{
+		Name:     "zxPluginsInject",
+		File:     "resources/zxPluginsInject.dylib",
+		LoadName: "@rpath/zxPluginsInject.dylib",
+		LoadCmd:  types.LC_LOAD_WEAK_DYLIB,
+		Dest:     "Frameworks/zxPluginsInject.dylib",
+		Targets:  TargetAll,
+	},
+}
+
+func init() {
+	for _, p := range payloads {
+		p.manifest = sync.OnceValues(func() (*PayloadManifest, error) {
+			return readManifest(payloadFS, p.File)
+		})
+	}
+}
+
+func lookupPayload(name string) (*Payload, error) {
+	if name == "" {
+		return payloads[0], nil
+	}
+	for _, p := range payloads {
+		if strings.EqualFold(p.Name, name) {
+			return p, nil
+		}
+	}
+
+	names := make([]string, len(payloads))
+	for i, p := range payloads {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("unknown payload %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// Manifest describes the payload's file, see PayloadManifest.
+func (p *Payload) Manifest() (*PayloadManifest, error) {
+	return p.manifest()
+}
+
+// Open opens the payload's file along with the fs.FileInfo to write it with.
+func (p *Payload) Open() (fs.File, fs.FileInfo, error) {
+	m, err := p.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := payloadFS.Open(p.File)
+	return f, payloadInfo{m}, err
+}
+
+// PayloadManifest describes an embedded payload. It's derived from the file
+// itself the first time it's needed, so replacing the file in resources/ is
+// all a fork has to do to ship a different dylib.
+type PayloadManifest struct {
+	Name    string
+	Size    int64
+	SHA256  string
+	Version string // current version from LC_ID_DYLIB
+	Arches  []string
+}
+
+func readManifest(fsys fs.FS, name string) (*PayloadManifest, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	m := &PayloadManifest{
+		Name:    path.Base(name),
+		Size:    int64(len(data)),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Version: "unknown",
+	}
+
+	var files []*macho.File
+	fat, err := macho.NewFatFile(bytes.NewReader(data))
+	if err == nil {
+		defer fat.Close()
+		for _, arch := range fat.Arches {
+			files = append(files, arch.File)
+		}
+	} else if errors.Is(err, macho.ErrNotFat) {
+		f, err := macho.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("embedded payload %s isn't a MachO file: %w", m.Name, err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	} else {
+		return nil, fmt.Errorf("embedded payload %s isn't a MachO file: %w", m.Name, err)
+	}
+
+	for _, f := range files {
+		m.Arches = append(m.Arches, strings.ToLower(f.SubCPU.String(f.CPU)))
+		if id := f.DylibID(); id != nil {
+			m.Version = id.CurrentVersion.String()
+		}
+	}
+	return m, nil
+}
+
+func (m *PayloadManifest) String() string {
+	return fmt.Sprintf("%s %s (%s, %d bytes, sha256 %s)", m.Name, m.Version, strings.Join(m.Arches, ", "), m.Size, m.SHA256)
+}
+
+// payloadInfo is the fs.FileInfo of an embedded payload as it's written to
+// the ipa. The one from embed.FS has the wrong permissions.
+type payloadInfo struct {
+	m *PayloadManifest
+}
+
+func (i payloadInfo) Name() string {
+	return i.m.Name
+}
+
+func (i payloadInfo) Size() int64 {
+	return i.m.Size
+}
+
+func (payloadInfo) Mode() fs.FileMode {
+	return 0755
+}
+
+// ModTime is always overridden by the timestamp of the ipa being patched
+// (see ipaLayout.ModTime), so it doesn't depend on when ipapatch ran.
+func (payloadInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (payloadInfo) IsDir() bool {
+	return false
+}
+
+func (payloadInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/blacktop/go-macho/types"
+	"howett.net/plist"
+)
+
+// bundleInfo identifies a bundle inside the app: the .app itself or one of
+// its plugins.
+type bundleInfo struct {
+	IsPlugin       bool
+	Executable     string
+	BundleID       string
+	ExtensionPoint string // NSExtensionPointIdentifier of plugins
+}
+
+// matches reports whether the glob pattern matches the executable name,
+// bundle ID or extension point of b.
+func (b bundleInfo) matches(pattern string) bool {
+	for _, s := range []string{b.Executable, b.BundleID, b.ExtensionPoint} {
+		if ok, _ := path.Match(pattern, s); ok && s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetRule says which bundles something applies to: which binaries get
+// a dylib's load command, which Info.plists get edited, etc.
+type TargetRule struct {
+	Main     bool     // the main app
+	Plugins  bool     // every plugin
+	Patterns []string // bundles whose executable name, bundle ID or extension point matches one of these globs
+}
+
+var (
+	TargetAll     = TargetRule{Main: true, Plugins: true}
+	TargetMain    = TargetRule{Main: true}
+	TargetPlugins = TargetRule{Plugins: true}
+)
+
+// parseTargetRule parses a list of selectors: "all", "main", "plugins" or
+// globs matched against executable names, bundle IDs and extension points.
+func parseTargetRule(selectors []string) (TargetRule, error) {
+	var r TargetRule
+	for _, sel := range selectors {
+		switch sel {
+		case "all":
+			r.Main, r.Plugins = true, true
+		case "main":
+			r.Main = true
+		case "plugins":
+			r.Plugins = true
+		case "":
+			return r, errors.New("empty target selector")
+		default:
+			if _, err := path.Match(sel, ""); err != nil {
+				return r, fmt.Errorf("invalid target selector %q: %w", sel, err)
+			}
+			r.Patterns = append(r.Patterns, sel)
+		}
+	}
+	return r, nil
+}
+
+func (r TargetRule) String() string {
+	var parts []string
+	switch {
+	case r.Main && r.Plugins:
+		parts = append(parts, "main app and plugins")
+	case r.Main:
+		parts = append(parts, "main app only")
+	case r.Plugins:
+		parts = append(parts, "plugins only")
+	}
+	if len(r.Patterns) > 0 {
+		parts = append(parts, "bundles matching "+strings.Join(r.Patterns, ", "))
+	}
+	if len(parts) == 0 {
+		return "nothing"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Matches reports whether the rule applies to b.
+func (r TargetRule) Matches(b bundleInfo) bool {
+	if b.IsPlugin && r.Plugins || !b.IsPlugin && r.Main {
+		return true
+	}
+	return slices.ContainsFunc(r.Patterns, b.matches)
+}
+
+// PluginFilter narrows down which plugins are patched at all (see
+// --include-plugin and --exclude-plugin). Both are globs matched against
+// executable names, bundle IDs and extension points.
+type PluginFilter struct {
+	Include []string // if any, only plugins matching one of these
+	Exclude []string
+}
+
+func newPluginFilter(include, exclude []string) (PluginFilter, error) {
+	for _, p := range slices.Concat(include, exclude) {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return PluginFilter{}, fmt.Errorf("invalid plugin filter %q", p)
+		}
+	}
+	return PluginFilter{Include: include, Exclude: exclude}, nil
+}
+
+// Allows reports whether b should be patched. The main app always is.
+func (f PluginFilter) Allows(b bundleInfo) bool {
+	if !b.IsPlugin {
+		return true
+	}
+	if len(f.Include) > 0 && !slices.ContainsFunc(f.Include, b.matches) {
+		return false
+	}
+	return !slices.ContainsFunc(f.Exclude, b.matches)
+}
+
+// loadCommand is a load command to add to a binary.
+type loadCommand struct {
+	Name     string        // e.g. "@rpath/zxPluginsInject.dylib"
+	Cmd      types.LoadCmd // LC_LOAD_WEAK_DYLIB or LC_LOAD_DYLIB
+	Position Position
+}
+
+// Position is where a load command goes among the dylibs a binary loads,
+// which is the order dyld runs their initializers in. The zero value adds
+// it after all of them.
+type Position struct {
+	First  bool   // before every dylib
+	Before string // before the first dylib this refers to (see refersTo)
+	After  string // right after it
+}
+
+// parsePosition parses first, last, before:<dylib> or after:<dylib>.
+func parsePosition(s string) (Position, error) {
+	var pos Position
+	switch s {
+	case "", "last":
+		return pos, nil
+	case "first":
+		pos.First = true
+		return pos, nil
+	}
+	if name, ok := strings.CutPrefix(s, "before:"); ok && name != "" {
+		pos.Before = name
+		return pos, nil
+	}
+	if name, ok := strings.CutPrefix(s, "after:"); ok && name != "" {
+		pos.After = name
+		return pos, nil
+	}
+	return pos, fmt.Errorf("unknown position %q (expected first, last, before:<dylib> or after:<dylib>)", s)
+}
+
+func (pos Position) String() string {
+	switch {
+	case pos.First:
+		return "first"
+	case pos.Before != "":
+		return "before:" + pos.Before
+	case pos.After != "":
+		return "after:" + pos.After
+	}
+	return "last"
+}
+
+// refersTo reports whether name, the argument of before: or after:, refers
+// to the dylib at dylibPath: it's either the whole path, one of its
+// components, like "UIKit" or "UIKit.framework" for
+// /System/Library/Frameworks/UIKit.framework/UIKit, or the file name up to
+// the first dot, like "libSystem" for /usr/lib/libSystem.B.dylib.
+func refersTo(name, dylibPath string) bool {
+	if stem, _, _ := strings.Cut(path.Base(dylibPath), "."); name == stem {
+		return true
+	}
+	return name == dylibPath || strings.Contains(dylibPath+"/", "/"+strings.Trim(name, "/")+"/")
+}
+
+// addOrder returns lcs in the order to add them in, so that the ones that
+// share a position end up in the order given. Each one added first or
+// after a dylib goes in front of the previous ones, so those are added in
+// reverse; each one added before a dylib goes right in front of it, after
+// the previous ones, like the ones added last.
+func addOrder(lcs []loadCommand) []loadCommand {
+	var reversed, inOrder []loadCommand
+	for _, lc := range lcs {
+		if lc.Position.First || lc.Position.After != "" {
+			reversed = append(reversed, lc)
+		} else {
+			inOrder = append(inOrder, lc)
+		}
+	}
+	slices.Reverse(reversed)
+	return append(reversed, inOrder...)
+}
+
+// injection is a dylib or framework to inject: the load command added to
+// the targets and the file (or directory) placed in the bundle, which comes
+// from either a built-in payload or a path on disk.
+type injection struct {
+	LoadCommand loadCommand
+	Dest        string // relative to the .app
+	Targets     TargetRule
+	payload     *Payload
+	sysPath     string
+}
+
+// plistEdit sets and deletes top-level keys in the Info.plist of the
+// bundles it targets.
+type plistEdit struct {
+	Targets TargetRule
+	Set     map[string]any
+	Delete  []string
+}
+
+// plan is everything to do to an app, built from either the command line
+// flags or a recipe (see --recipe). Both the ipa and the .app flows carry
+// it out the same way.
+type plan struct {
+	Injections []injection
+	PlistEdits []plistEdit
+	Remove     []string // relative to the .app
+	Plugins    PluginFilter
+}
+
+// buildPlan returns what to do according to args: the recipe if one was
+// given, otherwise the dylibs passed with -d if any, otherwise the selected
+// built-in payload. Either way, only to the plugins allowed by
+// --include-plugin and --exclude-plugin, with their load commands at
+// --position.
+func buildPlan(args Args) (*plan, error) {
+	filter, err := newPluginFilter(args.IncludePlugin, args.ExcludePlugin)
+	if err != nil {
+		return nil, err
+	}
+	p, err := basePlan(args)
+	if err != nil {
+		return nil, err
+	}
+	p.Plugins = filter
+
+	if args.Position != "" {
+		if args.Recipe != "" {
+			return nil, errors.New("--position can't be combined with --recipe, set the position of its dylibs instead")
+		}
+		pos, err := parsePosition(args.Position)
+		if err != nil {
+			return nil, err
+		}
+		for i := range p.Injections {
+			p.Injections[i].LoadCommand.Position = pos
+		}
+	}
+	return p, nil
+}
+
+func basePlan(args Args) (*plan, error) {
+	if args.Recipe != "" {
+		if len(args.Dylib) > 0 || args.Payload != "" || args.PluginsOnly {
+			return nil, errors.New("--recipe can't be combined with -d/--dylib, --payload or -p/--plugins-only")
+		}
+		r, err := LoadRecipe(args.Recipe)
+		if err != nil {
+			return nil, err
+		}
+		return r.plan(filepath.Dir(args.Recipe))
+	}
+
+	rule := TargetAll
+	if args.PluginsOnly {
+		rule = TargetPlugins
+	}
+
+	if len(args.Dylib) == 0 {
+		name, scope, err := splitScope(args.Payload)
+		if err != nil {
+			return nil, err
+		}
+		p, err := lookupPayload(name)
+		if err != nil {
+			return nil, err
+		}
+		if scope != nil {
+			rule = *scope
+		} else if !args.PluginsOnly {
+			rule = p.Targets
+		}
+		return &plan{Injections: []injection{{
+			LoadCommand: loadCommand{Name: p.LoadName, Cmd: p.LoadCmd},
+			Dest:        p.Dest,
+			Targets:     rule,
+			payload:     p,
+		}}}, nil
+	}
+	if args.Payload != "" {
+		logger.Info("--payload is ignored when -d/--dylib is specified")
+	}
+	cmd, err := parseLoadCmd(args.LoadCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var pl plan
+	seen := make(map[string]struct{})
+	for _, arg := range args.Dylib {
+		if arg == "" {
+			continue
+		}
+		dylibPath, scope, err := splitScope(arg)
+		if err != nil {
+			return nil, err
+		}
+		name := "@rpath/" + filepath.Base(dylibPath)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		targets := rule
+		if scope != nil {
+			targets = *scope
+		}
+		pl.Injections = append(pl.Injections, injection{
+			LoadCommand: loadCommand{Name: name, Cmd: cmd},
+			Dest:        path.Join("Frameworks", filepath.Base(dylibPath)),
+			Targets:     targets,
+			sysPath:     dylibPath,
+		})
+	}
+	return &pl, nil
+}
+
+// splitScope splits a -d or --payload argument into the dylib and the
+// bundles to inject it into, if given after a colon: "tweak.dylib:main",
+// "zxPluginsInject:plugins" or "tweak.dylib:Share,com.example.*" (see
+// parseTargetRule). Paths that exist as they are, or where what follows the
+// last colon looks like a path (e.g. C:\tweak.dylib), have no scope.
+func splitScope(arg string) (string, *TargetRule, error) {
+	i := strings.LastIndexByte(arg, ':')
+	if i < 0 || strings.ContainsAny(arg[i+1:], `/\`) {
+		return arg, nil, nil
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return arg, nil, nil
+	}
+
+	rule, err := parseTargetRule(strings.Split(arg[i+1:], ","))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid scope in %q: %w", arg, err)
+	}
+	return arg[:i], &rule, nil
+}
+
+// loadCommandsFor returns the load commands to add to the binary of b.
+func (p *plan) loadCommandsFor(b bundleInfo) []loadCommand {
+	var lcs []loadCommand
+	for _, inj := range p.Injections {
+		if inj.Targets.Matches(b) {
+			lcs = append(lcs, inj.LoadCommand)
+		}
+	}
+	return addOrder(lcs)
+}
+
+// editsFor returns the edits to make to the Info.plist of b.
+func (p *plan) editsFor(b bundleInfo) []plistEdit {
+	var edits []plistEdit
+	for _, e := range p.PlistEdits {
+		if e.Targets.Matches(b) {
+			edits = append(edits, e)
+		}
+	}
+	return edits
+}
+
+// pluginsOnly reports whether the plan only applies to plugins, in which
+// case the main app isn't even looked at.
+func (p *plan) pluginsOnly() bool {
+	if len(p.Injections) == 0 && len(p.PlistEdits) == 0 {
+		return false
+	}
+	for _, inj := range p.Injections {
+		if inj.Targets.Main || len(inj.Targets.Patterns) > 0 {
+			return false
+		}
+	}
+	for _, e := range p.PlistEdits {
+		if e.Targets.Main || len(e.Targets.Patterns) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// removed reports whether rel (relative to the .app) is removed by the plan,
+// either itself or as part of a removed directory.
+func (p *plan) removed(rel string) bool {
+	return slices.ContainsFunc(p.Remove, func(r string) bool {
+		return rel == r || strings.HasPrefix(rel, r+"/")
+	})
+}
+
+// applyPlistEdits applies edits to the contents of an Info.plist, keeping
+// its format.
+func applyPlistEdits(data []byte, edits []plistEdit) ([]byte, error) {
+	var m map[string]any
+	format, err := plist.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range edits {
+		for _, key := range e.Delete {
+			delete(m, key)
+		}
+		for key, val := range e.Set {
+			m[key] = plistValue(val)
+		}
+	}
+
+	if format == plist.XMLFormat || format == plist.OpenStepFormat || format == plist.GNUStepFormat {
+		return plist.MarshalIndent(m, format, "\t")
+	}
+	return plist.Marshal(m, format)
+}
+
+// plistValue converts values decoded from a recipe into ones that encode to
+// the expected plist types, mostly so whole numbers from JSON don't end up
+// as <real>.
+func plistValue(v any) any {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, vv := range v {
+			out[k] = plistValue(vv)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, vv := range v {
+			out[i] = plistValue(vv)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoSpace is returned by preflight if there isn't enough free space.
+var ErrNoSpace = errors.New("not enough free disk space")
+
+var errDiskSpaceUnsupported = errors.New("checking free disk space isn't supported on this platform")
+
+// preflight makes sure there's enough free space for patching an ipa
+// before any work starts: tmpNeeded bytes in tmpdir for the extracted
+// executables, and the size of the input plus everything added to it next
+// to the output, where the new ipa is written before replacing the output.
+func preflight(args Args, p *plan, tmpdir string, tmpNeeded uint64) error {
+	fi, err := os.Stat(args.Input)
+	if err != nil {
+		return err
+	}
+	outNeeded := uint64(fi.Size())
+	for _, inj := range p.Injections {
+		if inj.payload != nil {
+			if m, err := inj.payload.Manifest(); err == nil {
+				outNeeded += uint64(m.Size)
+			}
+			continue
+		}
+		outNeeded += treeSize(inj.sysPath)
+	}
+
+	tmpFree, tmpDev, err := diskSpace(tmpdir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to check free space in %s: %w", tmpdir, err)
+	}
+
+	outDir := filepath.Dir(args.Output)
+	outFree, outDev, err := diskSpace(outDir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space in %s: %w", outDir, err)
+	}
+
+	if tmpDev == outDev {
+		if need := tmpNeeded + outNeeded; need > tmpFree {
+			return fmt.Errorf("%w: need about %s in %s (temp files and output), but only %s is free",
+				ErrNoSpace, formatBytes(need), outDir, formatBytes(tmpFree))
+		}
+		return nil
+	}
+	if tmpNeeded > tmpFree {
+		return fmt.Errorf("%w: need about %s for temp files in %s, but only %s is free (see --tmpdir and --mem-limit)",
+			ErrNoSpace, formatBytes(tmpNeeded), tmpdir, formatBytes(tmpFree))
+	}
+	if outNeeded > outFree {
+		return fmt.Errorf("%w: need about %s for the output in %s, but only %s is free",
+			ErrNoSpace, formatBytes(outNeeded), outDir, formatBytes(outFree))
+	}
+	return nil
+}
+
+// treeSize returns the size of a file, or of all files in a directory.
+func treeSize(name string) uint64 {
+	var size uint64
+	filepath.WalkDir(name, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
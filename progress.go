@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// progress is shown while patching, so big ipas don't look stuck. Its
+// counters can always be updated, it only reports them between Start and
+// Stop.
+var progress = &Progress{}
+
+// Progress counts how far along patching is. On a terminal it's shown as a
+// status line below the logs, otherwise it's written as a JSON object per
+// line every few seconds, for whatever is reading ipapatch's output.
+type Progress struct {
+	phase        atomic.Value // string
+	targets      atomic.Int64
+	targetsTotal atomic.Int64
+	slices       atomic.Int64
+	copied       atomic.Int64
+	written      atomic.Int64
+	writeTotal   atomic.Int64
+
+	mu    sync.Mutex // guards the rest
+	out   io.Writer  // nil unless started
+	tty   bool
+	drawn bool   // whether the status line is on the screen
+	last  string // the last event written, to skip repeating it
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// progressEvent is what's written when not on a terminal.
+type progressEvent struct {
+	Event        string `json:"event"`
+	Phase        string `json:"phase"`
+	Targets      int64  `json:"targets"`
+	TargetsTotal int64  `json:"targets_total"`
+	Slices       int64  `json:"slices_signed"`
+	Copied       int64  `json:"bytes_copied"`
+	Written      int64  `json:"bytes_written"`
+	WriteTotal   int64  `json:"bytes_total,omitempty"`
+}
+
+// Start starts reporting progress to stderr.
+func (p *Progress) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fi, err := os.Stderr.Stat()
+	p.tty = err == nil && fi.Mode()&os.ModeCharDevice != 0
+	p.out = os.Stderr
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	interval := 2 * time.Second
+	if p.tty {
+		interval = 100 * time.Millisecond
+	}
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.report()
+			}
+		}
+	}()
+}
+
+// Stop stops reporting progress, removing the status line or writing a
+// last event.
+func (p *Progress) Stop() {
+	p.mu.Lock()
+	started := p.out != nil
+	p.mu.Unlock()
+	if !started {
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+	if !p.tty {
+		p.report()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearLocked()
+	p.out = nil
+}
+
+// SetPhase sets what's being done, e.g. "injecting".
+func (p *Progress) SetPhase(phase string) {
+	p.phase.Store(phase)
+}
+
+// AddTargets adds n to the number of executables to patch.
+func (p *Progress) AddTargets(n int) {
+	p.targetsTotal.Add(int64(n))
+}
+
+// TargetDone counts an executable as patched.
+func (p *Progress) TargetDone() {
+	p.targets.Add(1)
+}
+
+// SliceSigned counts a (slice of an) executable as re-signed.
+func (p *Progress) SliceSigned() {
+	p.slices.Add(1)
+}
+
+// SetWriteTotal sets the (approximate) size of what's being written.
+func (p *Progress) SetWriteTotal(n int64) {
+	p.writeTotal.Store(n)
+}
+
+// Copying returns a writer that writes to w, counting the bytes as copied.
+func (p *Progress) Copying(w io.Writer) io.Writer {
+	return countingWriter{w, &p.copied}
+}
+
+// Writing returns a writer that writes to w, counting the bytes as written
+// to the output.
+func (p *Progress) Writing(w io.Writer) io.Writer {
+	return countingWriter{w, &p.written}
+}
+
+func (p *Progress) event() progressEvent {
+	phase, _ := p.phase.Load().(string)
+	return progressEvent{
+		Event:        "progress",
+		Phase:        phase,
+		Targets:      p.targets.Load(),
+		TargetsTotal: p.targetsTotal.Load(),
+		Slices:       p.slices.Load(),
+		Copied:       p.copied.Load(),
+		Written:      p.written.Load(),
+		WriteTotal:   p.writeTotal.Load(),
+	}
+}
+
+func (p *Progress) report() {
+	e := p.event()
+	if e.Phase == "" {
+		return // nothing started yet
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.out == nil {
+		return
+	}
+
+	if !p.tty {
+		b, _ := json.Marshal(e)
+		if line := string(b); line != p.last {
+			fmt.Fprintln(p.out, line)
+			p.last = line
+		}
+		return
+	}
+
+	if line := e.String(); !p.drawn || line != p.last {
+		fmt.Fprint(p.out, "\r\033[K"+line)
+		p.last = line
+		p.drawn = true
+	}
+}
+
+// clearLine removes the status line, so a log message can take its place.
+// It's drawn again on the next tick.
+func (p *Progress) clearLine() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearLocked()
+}
+
+func (p *Progress) clearLocked() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+func (e progressEvent) String() string {
+	parts := []string{e.Phase + ":"}
+	if e.TargetsTotal > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d executables patched,", e.Targets, e.TargetsTotal))
+	}
+	if e.Slices > 0 {
+		parts = append(parts, fmt.Sprintf("%d slices re-signed,", e.Slices))
+	}
+	if e.Copied > 0 {
+		parts = append(parts, fmt.Sprintf("%s copied,", formatBytes(uint64(e.Copied))))
+	}
+	if e.WriteTotal > 0 {
+		const width = 20
+		done := min(e.Written*width/e.WriteTotal, width)
+		parts = append(parts, fmt.Sprintf("[%s%s] %s/%s written",
+			strings.Repeat("#", int(done)), strings.Repeat("-", int(width-done)),
+			formatBytes(uint64(e.Written)), formatBytes(uint64(e.WriteTotal))))
+	} else if e.Written > 0 {
+		parts = append(parts, fmt.Sprintf("%s written", formatBytes(uint64(e.Written))))
+	}
+	return strings.TrimSuffix(strings.Join(parts, " "), ",")
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// progressCore clears the status line before every log message.
+type progressCore struct {
+	zapcore.Core
+}
+
+func (c progressCore) With(fields []zapcore.Field) zapcore.Core {
+	return progressCore{c.Core.With(fields)}
+}
+
+func (c progressCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c progressCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	progress.clearLine()
+	return c.Core.Write(e, fields)
+}
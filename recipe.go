@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/blacktop/go-macho/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Recipe is a declarative description of a patch, loaded from a YAML, JSON
+// or TOML file with --recipe. Paths on disk are relative to the recipe,
+// paths inside the app are relative to the .app.
+//
+//	dylibs:
+//	  - path: tweak.dylib
+//	    load: strong                # or weak (default)
+//	    position: before:UIKit      # or first, after:<dylib>, last (default)
+//	    targets: [main]             # all (default), main, plugins or globs
+//	  - payload: zxPluginsInject
+//	    targets: [plugins]
+//	frameworks:
+//	  - path: Cool.framework        # loaded as @rpath/Cool.framework/Cool
+//	plist:
+//	  - targets: [main]
+//	    set: {UISupportsDocumentBrowser: true}
+//	    delete: [UISupportedDevices]
+//	remove:
+//	  - Watch
+//	  - PlugIns/Junk.appex
+type Recipe struct {
+	Dylibs     []RecipeDylib     `json:"dylibs" yaml:"dylibs" toml:"dylibs"`
+	Frameworks []RecipeDylib     `json:"frameworks" yaml:"frameworks" toml:"frameworks"`
+	Plist      []RecipePlistEdit `json:"plist" yaml:"plist" toml:"plist"`
+	Remove     []string          `json:"remove" yaml:"remove" toml:"remove"`
+}
+
+// RecipeDylib is a dylib or framework to inject.
+type RecipeDylib struct {
+	Path     string   `json:"path" yaml:"path" toml:"path"`             // on disk
+	Payload  string   `json:"payload" yaml:"payload" toml:"payload"`    // built-in payload instead of path (dylibs only)
+	Load     string   `json:"load" yaml:"load" toml:"load"`             // "weak" (default) or "strong"
+	Name     string   `json:"name" yaml:"name" toml:"name"`             // load command path, defaults to @rpath/...
+	Position string   `json:"position" yaml:"position" toml:"position"` // like --position, defaults to last
+	Dest     string   `json:"dest" yaml:"dest" toml:"dest"`             // defaults to Frameworks/<file>
+	Targets  []string `json:"targets" yaml:"targets" toml:"targets"`    // defaults to all
+}
+
+// RecipePlistEdit sets and deletes top-level Info.plist keys.
+type RecipePlistEdit struct {
+	Targets []string       `json:"targets" yaml:"targets" toml:"targets"` // defaults to main
+	Set     map[string]any `json:"set" yaml:"set" toml:"set"`
+	Delete  []string       `json:"delete" yaml:"delete" toml:"delete"`
+}
+
+// LoadRecipe reads a recipe, picking the format by file extension. Unknown
+// keys are errors, so typos don't silently do nothing.
+func LoadRecipe(name string) (*Recipe, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var r Recipe
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&r)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&r)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), &r)
+		if err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown key %q", undecoded[0].String())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported recipe format %q (expected .yaml, .yml, .json or .toml)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recipe %s: %w", name, err)
+	}
+
+	if err = r.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid recipe %s:\n%w", name, err)
+	}
+	return &r, nil
+}
+
+// Validate checks the recipe against what ipapatch supports, reporting
+// every problem at once.
+func (r *Recipe) Validate() error {
+	var errs []error
+	report := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf("  "+format, a...))
+	}
+
+	// the load command names and (case-insensitive) destinations seen so
+	// far, and where
+	names := make(map[string]string)
+	dests := make(map[string]string)
+	validateDylib := func(field string, i int, d RecipeDylib) {
+		where := fmt.Sprintf("%s[%d]", field, i)
+		var p *Payload
+		switch {
+		case d.Path == "" && d.Payload == "":
+			report("%s: one of path or payload is required", where)
+		case d.Path != "" && d.Payload != "":
+			report("%s: path and payload are mutually exclusive", where)
+		case d.Payload != "" && field == "frameworks":
+			report("%s: payload can't be used for frameworks", where)
+		case d.Payload != "":
+			var err error
+			if p, err = lookupPayload(d.Payload); err != nil {
+				report("%s: %v", where, err)
+			}
+		}
+		if d.Payload == "" && d.Path != "" || p != nil {
+			name, dest := d.placement(p, field == "frameworks")
+			if other, ok := names[name]; ok {
+				report("%s.name: %q is also the load command of %s", where, name, other)
+			} else {
+				names[name] = where
+			}
+			if other, ok := dests[strings.ToLower(dest)]; ok {
+				report("%s.dest: %q is also the dest of %s", where, dest, other)
+			} else {
+				dests[strings.ToLower(dest)] = where
+			}
+		}
+		if _, err := parseLoadCmd(d.Load); err != nil {
+			report("%s.load: %v", where, err)
+		}
+		if _, err := parsePosition(d.Position); err != nil {
+			report("%s.position: %v", where, err)
+		}
+		if d.Dest != "" && !validBundlePath(d.Dest) {
+			report("%s.dest: %q must be a relative path inside the .app", where, d.Dest)
+		}
+		if _, err := parseTargetRule(d.Targets); err != nil {
+			report("%s.targets: %v", where, err)
+		}
+	}
+	for i, d := range r.Dylibs {
+		validateDylib("dylibs", i, d)
+	}
+	for i, d := range r.Frameworks {
+		validateDylib("frameworks", i, d)
+		if d.Path != "" && !strings.HasSuffix(strings.TrimSuffix(d.Path, "/"), ".framework") {
+			report("frameworks[%d].path: %q isn't a .framework", i, d.Path)
+		}
+	}
+
+	for i, e := range r.Plist {
+		if len(e.Set) == 0 && len(e.Delete) == 0 {
+			report("plist[%d]: nothing to set or delete", i)
+		}
+		if _, err := parseTargetRule(e.Targets); err != nil {
+			report("plist[%d].targets: %v", i, err)
+		}
+	}
+
+	for i, rm := range r.Remove {
+		if !validBundlePath(rm) {
+			report("remove[%d]: %q must be a relative path inside the .app", i, rm)
+		}
+	}
+
+	if len(r.Dylibs) == 0 && len(r.Frameworks) == 0 && len(r.Plist) == 0 && len(r.Remove) == 0 {
+		report("nothing to do")
+	}
+	return errors.Join(errs...)
+}
+
+// plan converts a validated recipe into a plan, resolving paths on disk
+// relative to dir.
+func (r *Recipe) plan(dir string) (*plan, error) {
+	var pl plan
+
+	addInjection := func(d RecipeDylib, isFramework bool) error {
+		var inj injection
+		var err error
+		if inj.LoadCommand.Cmd, err = parseLoadCmd(d.Load); err != nil {
+			return err
+		}
+		if inj.LoadCommand.Position, err = parsePosition(d.Position); err != nil {
+			return err
+		}
+		if inj.Targets, err = parseTargetRule(orDefault(d.Targets, "all")); err != nil {
+			return err
+		}
+
+		if d.Payload != "" {
+			if inj.payload, err = lookupPayload(d.Payload); err != nil {
+				return err
+			}
+		} else {
+			inj.sysPath = d.Path
+			if !filepath.IsAbs(inj.sysPath) {
+				inj.sysPath = filepath.Join(dir, inj.sysPath)
+			}
+			if _, err = os.Stat(inj.sysPath); err != nil {
+				return err
+			}
+		}
+		inj.LoadCommand.Name, inj.Dest = d.placement(inj.payload, isFramework)
+
+		pl.Injections = append(pl.Injections, inj)
+		return nil
+	}
+	for _, d := range r.Dylibs {
+		if err := addInjection(d, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range r.Frameworks {
+		if err := addInjection(d, true); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range r.Plist {
+		rule, err := parseTargetRule(orDefault(e.Targets, "main"))
+		if err != nil {
+			return nil, err
+		}
+		pl.PlistEdits = append(pl.PlistEdits, plistEdit{Targets: rule, Set: e.Set, Delete: e.Delete})
+	}
+
+	for _, rm := range r.Remove {
+		pl.Remove = append(pl.Remove, path.Clean(rm))
+	}
+	return &pl, nil
+}
+
+// placement returns the load command name and the path inside the .app of
+// d, which default to those of its payload p (nil if it has none) or to
+// @rpath/<name> and Frameworks/<name> for its file.
+func (d RecipeDylib) placement(p *Payload, isFramework bool) (name, dest string) {
+	if p != nil {
+		name, dest = p.LoadName, p.Dest
+	} else {
+		base := filepath.Base(d.Path)
+		name = "@rpath/" + base
+		if isFramework {
+			name += "/" + strings.TrimSuffix(base, ".framework")
+		}
+		dest = path.Join("Frameworks", base)
+	}
+	if d.Name != "" {
+		name = d.Name
+	}
+	if d.Dest != "" {
+		dest = path.Clean(d.Dest)
+	}
+	return name, dest
+}
+
+func parseLoadCmd(s string) (types.LoadCmd, error) {
+	switch s {
+	case "", "weak":
+		return types.LC_LOAD_WEAK_DYLIB, nil
+	case "strong":
+		return types.LC_LOAD_DYLIB, nil
+	}
+	return 0, fmt.Errorf("unknown load command type %q (expected weak or strong)", s)
+}
+
+// validBundlePath reports whether p is a path inside the .app.
+func validBundlePath(p string) bool {
+	return p != "" && !path.IsAbs(p) && !strings.Contains(p, "\\") &&
+		path.Clean(p) != "." && !strings.HasPrefix(path.Clean(p), "../") && path.Clean(p) != ".."
+}
+
+func orDefault(selectors []string, def string) []string {
+	if len(selectors) == 0 {
+		return []string{def}
+	}
+	return selectors
+}